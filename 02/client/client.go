@@ -1,29 +1,60 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
+	"os"
 	"tcp-sim/computer"
 	"tcp-sim/header"
+	"time"
 )
 
 func main() {
-	var c computer.Computer
-	c.HandleArgs()
-	c.Dial()
-	defer c.Conn.Close()
+	// exit only once run's defers closed the capture
+	if err := run(); err != nil {
+		if errors.Is(err, computer.ErrUsage) {
+			fmt.Println(computer.ErrUsage)
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg, err := computer.ParseArgs(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	defer cfg.Capture.Close()
+	c, err := computer.New(cfg)
+	if err != nil {
+		return err
+	}
+	if err := c.Dial(); err != nil {
+		return err
+	}
+	defer c.Close()
 
 	// send syn
 	var syn header.Header
 	header.SetSyn(&syn)
-	header.SetSeq(&syn, c.Seq)
-	header.FillPorts(&syn, c.Conn, c.Conn.RemoteAddr().(*net.UDPAddr).Port)
+	header.SetSeq(&syn, c.ISN(c.RemoteAddr()))
+	header.FillPorts(&syn, c.UDPConn(), c.RemoteAddr().Port)
 
-	c.Conn.Write(syn[:])
+	if err := c.SendHeader(syn, nil); err != nil {
+		return err
+	}
 	syn.Print("CLIENT: SENT SYN")
 
-	// receive synack
-	synAck, _ := c.ReadHeader()
+	// receive synack, give up if the server never answers
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	synAck, _, err := c.ReadHeader(ctx)
+	if err != nil {
+		return err
+	}
 	if header.IsSynAck(&synAck) {
 		synAck.Print("CLIENT: RECEIVED SYNACK")
 	}
@@ -33,10 +64,13 @@ func main() {
 	header.SetAck(&ack)
 	header.SetSeq(&ack, header.GetAckNum(&synAck))
 	header.SetAckNum(&ack, header.GetSeq(&synAck)+1)
-	header.FillPorts(&ack, c.Conn, c.Conn.RemoteAddr().(*net.UDPAddr).Port)
+	header.FillPorts(&ack, c.UDPConn(), c.RemoteAddr().Port)
 
-	c.Conn.Write(ack[:])
+	if err := c.SendHeader(ack, nil); err != nil {
+		return err
+	}
 	ack.Print("CLIENT: SENT ACK")
 
 	fmt.Printf("\nHandshake complete.")
+	return nil
 }
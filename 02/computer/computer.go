@@ -1,82 +1,383 @@
 package computer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"tcp-sim/header"
+	"tcp-sim/ip"
+	"tcp-sim/isn"
+	"tcp-sim/netem"
+	"tcp-sim/pcap"
 )
 
-var BUF = make([]byte, 20)
+// largest datagram we read: header plus payload
+const MaxDatagram = 1500
+
+var (
+	ErrUsage        = errors.New("usage: go run ./server|client <[host:]port> [isn|auto] [capture.pcap]")
+	ErrBadNetwork   = errors.New("network must be udp, udp4 or udp6")
+	ErrBadISN       = errors.New("isn must be a number from 0 to 4294967295")
+	ErrNotOpen      = errors.New("no socket, call Listen or Dial first")
+	ErrShortSegment = errors.New("datagram shorter than a tcp header")
+	ErrBadChecksum  = errors.New("bad tcp checksum")
+	ErrNotIPv4      = errors.New("the simulated ip layer is ipv4 only")
+)
+
+// Error is what every Computer method returns when something fails. Op
+// says what it was doing, like net.OpError.
+type Error struct {
+	Op   string // "args", "new", "listen", "dial", "read" or "send"
+	Addr string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Addr == "" {
+		return "computer " + e.Op + ": " + e.Err.Error()
+	}
+	return "computer " + e.Op + " " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether a read gave up because of a deadline.
+func (e *Error) Timeout() bool {
+	return errors.Is(e.Err, os.ErrDeadlineExceeded) || errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+// Config is what New needs to build a Computer.
+type Config struct {
+	// Addr is host:port to listen on, or of the server to dial. a bare
+	// port listens on all interfaces and dials localhost, port 0 listens
+	// on a free port, see LocalAddr.
+	Addr     string
+	BindAddr string // host:port Dial binds to, "" for any
+	Network  string // "udp" (the default), "udp4" or "udp6"
+	Seq      uint32 // initial sequence number, unless AutoISN
+	// AutoISN picks the ISN per connection with isn.Generate instead of
+	// using Seq, see ISN.
+	AutoISN bool
+
+	Link    *netem.Link  // optional lossy/slow link for SendSegment
+	Capture *pcap.Writer // optional, records every segment sent and read
+
+	// Host sends the segments through the simulated ip layer: they get
+	// an ip header and go to the host's gateway router, see package ip.
+	// Addr is then the simulated ip and the tcp port, the udp socket is
+	// the host's from the topology.
+	Host *ip.Host
+}
 
 type Computer struct {
-	Port string
-	Seq  uint32
-	Conn *net.UDPConn
+	Config
+	conn *net.UDPConn
+
+	// with a Host: our simulated ip and tcp port, and the peer's when
+	// dialed
+	ipLocal, ipRemote *net.UDPAddr
+
+	mu      sync.Mutex
+	localIP map[string]net.IP // our ip towards each peer, when bound to all interfaces
 }
 
-func (c *Computer) HandleArgs() {
-	expectedArgs := 3
+// ParseArgs reads "<[host:]port> [isn|auto] [capture.pcap]", the
+// arguments of the client and server programs, and opens the capture file
+// if given. a left out isn is the same as auto.
+func ParseArgs(args []string) (Config, error) {
+	var cfg Config
+	if len(args) < 1 || len(args) > 3 {
+		return cfg, &Error{Op: "args", Err: ErrUsage}
+	}
 
-	if len(os.Args) != expectedArgs {
-		fmt.Println("Usage:", "go run ./server|client <server-port> <isn>")
-		os.Exit(1)
+	cfg.Addr = args[0]
+	if len(args) == 1 || args[1] == "auto" {
+		cfg.AutoISN = true
+	} else {
+		seq, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return cfg, &Error{Op: "args", Err: ErrBadISN}
+		}
+		cfg.Seq = uint32(seq)
 	}
 
-	c.Port = os.Args[1]
-	seqInt, err := strconv.Atoi(os.Args[2])
-	if err != nil {
-		panic(err)
+	if len(args) == 3 {
+		var err error
+		cfg.Capture, err = pcap.Create(args[2])
+		if err != nil {
+			return cfg, &Error{Op: "args", Err: err}
+		}
 	}
-	c.Seq = uint32(seqInt)
+	return cfg, nil
 }
 
-func (c *Computer) GetAddr(listen bool) *net.UDPAddr {
-	addr, err := net.ResolveUDPAddr("udp", ":"+c.Port)
-	if err != nil {
-		panic(err)
+// New checks cfg and returns a Computer without a socket yet.
+func New(cfg Config) (*Computer, error) {
+	switch cfg.Network {
+	case "":
+		cfg.Network = "udp"
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &Error{Op: "new", Addr: cfg.Network, Err: ErrBadNetwork}
+	}
+	if cfg.Host != nil && cfg.Network == "udp6" {
+		return nil, &Error{Op: "new", Addr: cfg.Network, Err: ErrNotIPv4}
 	}
-	if listen {
-		fmt.Printf("Listening on port %s\n", c.Port)
+	for _, a := range []string{cfg.Addr, cfg.BindAddr} {
+		if a == "" || strings.Contains(a, ":") {
+			continue
+		}
+		if _, err := strconv.ParseUint(a, 10, 16); err != nil {
+			return nil, &Error{Op: "new", Addr: a, Err: errors.New("want host:port or a port")}
+		}
+	}
+	return &Computer{Config: cfg, localIP: make(map[string]net.IP)}, nil
+}
+
+// endpoint turns a bare port into host:port.
+func endpoint(addr, host string) string {
+	if addr != "" && !strings.Contains(addr, ":") {
+		return net.JoinHostPort(host, addr)
 	}
 	return addr
 }
 
-func (c *Computer) Listen() {
-	addr := c.GetAddr(true)
-	conn, err := net.ListenUDP("udp", addr)
+// Listen binds the udp socket to Addr.
+func (c *Computer) Listen() error {
+	if c.Host != nil {
+		return c.listenIP()
+	}
+	addr, err := net.ResolveUDPAddr(c.Network, endpoint(c.Addr, ""))
+	if err == nil {
+		c.conn, err = net.ListenUDP(c.Network, addr)
+	}
 	if err != nil {
-		panic(err)
+		return &Error{Op: "listen", Addr: c.Addr, Err: err}
 	}
-	c.Conn = conn
+	return nil
 }
 
-func (c *Computer) Dial() {
-	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:"+c.Port)
-	if err != nil {
-		panic(err)
+// Dial connects the udp socket to the server at Addr, from BindAddr if
+// set.
+func (c *Computer) Dial() error {
+	if c.Host != nil {
+		return c.dialIP()
+	}
+	var laddr *net.UDPAddr
+	addr, err := net.ResolveUDPAddr(c.Network, endpoint(c.Addr, "localhost"))
+	if err == nil && c.BindAddr != "" {
+		laddr, err = net.ResolveUDPAddr(c.Network, endpoint(c.BindAddr, ""))
+	}
+	if err == nil {
+		c.conn, err = net.DialUDP(c.Network, laddr, addr)
 	}
-	conn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "dial", Addr: c.Addr, Err: err}
+	}
+	return nil
+}
+
+// ISN is the initial sequence number for a connection with remote: Seq,
+// or with AutoISN one from the rfc 6528 generator.
+func (c *Computer) ISN(remote *net.UDPAddr) uint32 {
+	if !c.AutoISN {
+		return c.Seq
+	}
+	return isn.Generate(c.LocalAddrFor(remote), remote)
+}
+
+// UDPConn is the socket from Listen or Dial, nil before.
+func (c *Computer) UDPConn() *net.UDPConn {
+	return c.conn
+}
+
+// LocalAddr is the address the socket is bound to, with the real port
+// when it was 0. with a Host it is the simulated ip and our tcp port.
+func (c *Computer) LocalAddr() *net.UDPAddr {
+	if c.ipLocal != nil {
+		return c.ipLocal
+	}
+	return c.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// LocalAddrFor is our address as remote sees it. a socket bound to all
+// interfaces has no ip of its own, so we ask the routing table which one
+// the datagrams to remote leave from. the checksum needs it.
+func (c *Computer) LocalAddrFor(remote *net.UDPAddr) *net.UDPAddr {
+	local := c.LocalAddr()
+	if remote == nil || !local.IP.IsUnspecified() {
+		return local
+	}
+
+	key := remote.IP.String()
+	c.mu.Lock()
+	ip, ok := c.localIP[key]
+	c.mu.Unlock()
+	if !ok {
+		// a udp "connect" sends nothing, it only picks the route
+		ip = remote.IP
+		if probe, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: remote.IP, Port: 9, Zone: remote.Zone}); err == nil {
+			ip = probe.LocalAddr().(*net.UDPAddr).IP
+			probe.Close()
+		}
+		c.mu.Lock()
+		c.localIP[key] = ip
+		c.mu.Unlock()
 	}
-	c.Conn = conn
+	return &net.UDPAddr{IP: ip, Port: local.Port, Zone: local.Zone}
+}
+
+// RemoteAddr is the dialed address, nil for a listening computer.
+func (c *Computer) RemoteAddr() *net.UDPAddr {
+	if c.Host != nil {
+		return c.ipRemote
+	}
+	addr, _ := c.conn.RemoteAddr().(*net.UDPAddr)
+	return addr
 }
 
-func (c *Computer) ReadHeader() (header.Header, *net.UDPAddr) {
-	_, clientAddr, err := c.Conn.ReadFromUDP(BUF)
+func (c *Computer) Close() error {
+	if c.conn == nil {
+		return &Error{Op: "close", Addr: c.Addr, Err: ErrNotOpen}
+	}
+	return c.conn.Close()
+}
+
+// read reads one datagram. it gives up when ctx is done, and takes the
+// read deadline from ctx.
+func (c *Computer) read(ctx context.Context, buf []byte) (int, *net.UDPAddr, error) {
+	if c.conn == nil {
+		return 0, nil, &Error{Op: "read", Addr: c.Addr, Err: ErrNotOpen}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, &Error{Op: "read", Addr: c.Addr, Err: err}
+	}
+
+	deadline, _ := ctx.Deadline() // zero, so no deadline, if ctx has none
+	c.conn.SetReadDeadline(deadline)
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetReadDeadline(time.Unix(1, 0)) // wake the blocked read
+		close(fired)
+	})
+
+	n, addr, err := c.conn.ReadFromUDP(buf)
+	if !stop() {
+		<-fired // let it finish, so it can't hit the next read
+	}
 	if err != nil {
-		panic(err)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return 0, nil, &Error{Op: "read", Addr: c.Addr, Err: err}
 	}
+	return n, addr, nil
+}
+
+// ReadHeader reads one datagram that carries only a header.
+func (c *Computer) ReadHeader(ctx context.Context) (header.Header, *net.UDPAddr, error) {
+	h, _, addr, err := c.ReadSegment(ctx)
+	return h, addr, err
+}
+
+// ReadSegment reads one datagram and splits it into header and payload.
+// a segment with a wrong checksum is an error, like a short one.
+func (c *Computer) ReadSegment(ctx context.Context) (header.Header, []byte, *net.UDPAddr, error) {
 	var h header.Header
-	copy(h[:], BUF)
-	return h, clientAddr
+	buf := make([]byte, MaxDatagram)
+	var seg []byte
+	var addr *net.UDPAddr
+	for seg == nil {
+		n, from, err := c.read(ctx, buf)
+		if err != nil {
+			return h, nil, nil, err
+		}
+		seg, addr = buf[:n], from
+		if c.Host != nil {
+			if seg, addr, err = c.unwrap(seg); err != nil {
+				return h, nil, nil, err
+			}
+		}
+	}
+	if len(seg) < len(h) {
+		return h, nil, addr, &Error{Op: "read", Addr: c.Addr, Err: fmt.Errorf("%w: %d bytes from %v", ErrShortSegment, len(seg), addr)}
+	}
+	if !header.ValidChecksum(seg, addr.IP, c.LocalAddrFor(addr).IP) {
+		return h, nil, addr, &Error{Op: "read", Addr: c.Addr, Err: fmt.Errorf("%w from %v", ErrBadChecksum, addr)}
+	}
+	c.capture(true, addr, seg)
+	copy(h[:], seg)
+	return h, seg[len(h):], addr, nil
 }
 
-func (c *Computer) SendHeader(h header.Header, addr *net.UDPAddr) {
-	_, err := c.Conn.WriteToUDP(h[:], addr)
-	if err != nil {
-		panic(err)
+// SendHeader sends h to addr, or to the remote of a dialed computer if
+// addr is nil.
+func (c *Computer) SendHeader(h header.Header, addr *net.UDPAddr) error {
+	return c.SendSegment(h, nil, addr)
+}
+
+// SendSegment fills in the checksum and sends header and payload in one
+// datagram, through Link if there is one. addr is nil on a dialed
+// computer.
+func (c *Computer) SendSegment(h header.Header, payload []byte, addr *net.UDPAddr) error {
+	if c.conn == nil {
+		return &Error{Op: "send", Addr: c.Addr, Err: ErrNotOpen}
+	}
+	out := make([]byte, 0, len(h)+len(payload))
+	out = append(out, h[:]...)
+	out = append(out, payload...)
+	remote := addr
+	if remote == nil {
+		remote = c.RemoteAddr()
+	}
+	header.SetChecksum(out, c.LocalAddrFor(remote).IP, remote.IP)
+	c.capture(false, addr, out)
+	if c.Host != nil {
+		out = c.wrap(out, remote)
+	}
+	write := func(b []byte) error {
+		var err error
+		switch {
+		case c.Host != nil:
+			_, err = c.conn.WriteToUDP(b, c.Host.Gateway)
+		case addr == nil:
+			_, err = c.conn.Write(b)
+		default:
+			_, err = c.conn.WriteToUDP(b, addr)
+		}
+		if err != nil {
+			return &Error{Op: "send", Addr: c.Addr, Err: err}
+		}
+		return nil
+	}
+	if c.Link != nil {
+		return c.Link.Send(out, write)
+	}
+	return write(out)
+}
+
+// capture records b in the pcap file, if there is one. remote is nil on a
+// dialed computer.
+func (c *Computer) capture(in bool, remote *net.UDPAddr, b []byte) {
+	if c.Capture == nil {
+		return
+	}
+	if remote == nil {
+		remote = c.RemoteAddr()
+	}
+	local := c.LocalAddrFor(remote)
+	if in {
+		c.Capture.WriteSegment(remote, local, b)
+	} else {
+		c.Capture.WriteSegment(local, remote, b)
 	}
 }
@@ -0,0 +1,110 @@
+package computer
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+
+	"tcp-sim/ip"
+)
+
+// the tcp port a dialing host picks when BindAddr has none
+const ephemeralLow, ephemeralHigh = 49152, 65535
+
+// listenIP binds the host's udp socket and takes the tcp port from Addr.
+func (c *Computer) listenIP() error {
+	port, err := c.tcpPort(c.Addr)
+	if err == nil {
+		c.conn, err = net.ListenUDP("udp4", c.Host.Link)
+	}
+	if err != nil {
+		return &Error{Op: "listen", Addr: c.Addr, Err: err}
+	}
+	c.ipLocal = &net.UDPAddr{IP: c.Host.IP, Port: port}
+	return nil
+}
+
+// dialIP binds the host's udp socket. nothing is connected, every
+// datagram goes to the gateway and the routers find the way to Addr.
+func (c *Computer) dialIP() error {
+	remote, err := net.ResolveUDPAddr("udp4", c.Addr)
+	if err == nil && remote.IP.To4() == nil {
+		err = ErrNotIPv4
+	}
+	port := 0
+	if err == nil && c.BindAddr != "" {
+		port, err = c.tcpPort(c.BindAddr)
+	}
+	if err == nil {
+		c.conn, err = net.ListenUDP("udp4", c.Host.Link)
+	}
+	if err != nil {
+		return &Error{Op: "dial", Addr: c.Addr, Err: err}
+	}
+	if port == 0 {
+		port = ephemeralLow + rand.Intn(ephemeralHigh-ephemeralLow+1)
+	}
+	c.ipLocal = &net.UDPAddr{IP: c.Host.IP, Port: port}
+	c.ipRemote = remote
+	return nil
+}
+
+// tcpPort is the port in a host:port or bare port, 0 picks one.
+func (c *Computer) tcpPort(addr string) (int, error) {
+	_, p, err := net.SplitHostPort(endpoint(addr, ""))
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	if port == 0 {
+		port = uint64(ephemeralLow + rand.Intn(ephemeralHigh-ephemeralLow+1))
+	}
+	return int(port), nil
+}
+
+// wrap puts the ip header in front of a segment to remote.
+func (c *Computer) wrap(seg []byte, remote *net.UDPAddr) []byte {
+	ttl := c.Host.TTL
+	if ttl <= 0 {
+		ttl = ip.DefaultTTL
+	}
+	h := ip.New(c.Host.IP, remote.IP, ip.ProtoTCP, ttl, len(seg))
+	return append(h[:], seg...)
+}
+
+// unwrap takes the ip header off a datagram and returns the segment and
+// the simulated address it came from. an icmp error about one of our
+// segments is returned as an *ip.ICMPError. datagrams that are not for
+// us give a nil segment and are skipped.
+func (c *Computer) unwrap(b []byte) ([]byte, *net.UDPAddr, error) {
+	h, payload, err := ip.Parse(b)
+	if err != nil {
+		return nil, nil, &Error{Op: "read", Addr: c.Addr, Err: err}
+	}
+	if !ip.GetDst(&h).Equal(c.Host.IP) {
+		return nil, nil, nil
+	}
+	src := ip.GetSrc(&h)
+	switch ip.GetProto(&h) {
+	case ip.ProtoICMP:
+		e := ip.ParseICMP(src, payload)
+		if e == nil || int(e.SrcPort) != c.ipLocal.Port {
+			return nil, nil, nil
+		}
+		return nil, nil, &Error{Op: "read", Addr: c.Addr, Err: e}
+	case ip.ProtoTCP:
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 4 || int(payload[2])<<8|int(payload[3]) != c.ipLocal.Port {
+		return nil, nil, nil // another port of this host
+	}
+	from := &net.UDPAddr{IP: src, Port: int(payload[0])<<8 | int(payload[1])}
+	if c.ipRemote != nil && !(from.IP.Equal(c.ipRemote.IP) && from.Port == c.ipRemote.Port) {
+		return nil, nil, nil // a dialed computer only talks to its peer
+	}
+	return payload, from, nil
+}
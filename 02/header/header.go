@@ -10,7 +10,9 @@ import (
 type Header [20]byte
 
 const ( // flags
+	FIN = 1 << 0
 	SYN = 1 << 1
+	RST = 1 << 2
 	ACK = 1 << 4
 )
 
@@ -30,6 +32,22 @@ func IsAck(h *Header) bool {
 	return h[13]&ACK != 0
 }
 
+func SetFin(h *Header) {
+	h[13] |= FIN
+}
+
+func IsFin(h *Header) bool {
+	return h[13]&FIN != 0
+}
+
+func SetRst(h *Header) {
+	h[13] |= RST
+}
+
+func IsRst(h *Header) bool {
+	return h[13]&RST != 0
+}
+
 func SetSynAck(h *Header) {
 	SetAck(h)
 	SetSyn(h)
@@ -67,6 +85,15 @@ func GetAckNum(h *Header) uint32 {
 		uint32(h[11])
 }
 
+func SetWindow(h *Header, win uint16) {
+	h[14] = byte(win >> 8)
+	h[15] = byte(win)
+}
+
+func GetWindow(h *Header) uint16 {
+	return uint16(h[14])<<8 | uint16(h[15])
+}
+
 func SetSrcPort(h *Header, port uint16) {
 	h[0] = byte(port >> 8)
 	h[1] = byte(port)
@@ -91,9 +118,64 @@ func SetDstPort(h *Header, port uint16) {
 
 func FillPorts(h *Header, conn *net.UDPConn, dst int) {
 	localPort := conn.LocalAddr().(*net.UDPAddr).Port
-	remotePort := dst
-	SetSrcPort(h, uint16(localPort))
-	SetDstPort(h, uint16(remotePort))
+	SetPorts(h, localPort, dst)
+}
+
+// SetPorts sets both ports. FillPorts takes the src port from the udp
+// socket, which is not our port once there is an ip layer below.
+func SetPorts(h *Header, src, dst int) {
+	SetSrcPort(h, uint16(src))
+	SetDstPort(h, uint16(dst))
+}
+
+func GetChecksum(h *Header) uint16 {
+	return uint16(h[16])<<8 | uint16(h[17])
+}
+
+// Checksum is the tcp checksum of seg, a header with its payload, sent
+// from src to dst. the checksum field itself counts as zero. the pseudo
+// header in front is 12 bytes for ipv4 and 40 bytes for ipv6 (rfc 9293
+// 3.1, rfc 8200 8.1), ipv4 is used when both addresses are ipv4.
+func Checksum(seg []byte, src, dst net.IP) uint16 {
+	var s uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			s += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			s += uint32(b[len(b)-1]) << 8
+		}
+	}
+
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		add(src4)
+		add(dst4)
+	} else {
+		add(src.To16())
+		add(dst.To16())
+	}
+	// zero, protocol 6 and the tcp length. for ipv6 the length is 32
+	// bits and the zeros come first, which sums to the same
+	s += 6 + uint32(len(seg))>>16 + uint32(len(seg))&0xffff
+
+	add(seg[:16])
+	add(seg[18:])
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// SetChecksum fills in the checksum of seg, see Checksum.
+func SetChecksum(seg []byte, src, dst net.IP) {
+	c := Checksum(seg, src, dst)
+	seg[16] = byte(c >> 8)
+	seg[17] = byte(c)
+}
+
+// ValidChecksum reports if the checksum in seg is right for src and dst.
+func ValidChecksum(seg []byte, src, dst net.IP) bool {
+	return len(seg) >= len(Header{}) && uint16(seg[16])<<8|uint16(seg[17]) == Checksum(seg, src, dst)
 }
 
 // Print method by ChatGPT (because not relevant to course, just fun to see)
@@ -114,6 +196,12 @@ func (h *Header) Print(label string) {
 	if IsAck(h) {
 		flags = append(flags, "ACK")
 	}
+	if IsFin(h) {
+		flags = append(flags, "FIN")
+	}
+	if IsRst(h) {
+		flags = append(flags, "RST")
+	}
 	if len(flags) == 0 {
 		flags = append(flags, "NONE")
 	}
@@ -0,0 +1,63 @@
+package header
+
+// tcp options go between the 20 byte header and the data. the data
+// offset (the high 4 bits of byte 12) says where the data starts, in 32
+// bit words. our headers used to leave it 0, which counts as 5 here: no
+// options.
+
+const (
+	optEnd = 0
+	optNop = 1
+	optMSS = 2
+)
+
+// DataOffset is the length of header plus options in bytes.
+func DataOffset(h *Header) int {
+	if n := int(h[12]>>4) * 4; n > len(h) {
+		return n
+	}
+	return len(h)
+}
+
+// SetDataOffset sets the length of header plus options, a multiple of 4.
+func SetDataOffset(h *Header, n int) {
+	h[12] = byte(n/4)<<4 | h[12]&0x0f
+}
+
+// SplitOptions splits what comes after the header into options and data.
+// an offset past the end of the segment gives no options and no data.
+func SplitOptions(h *Header, rest []byte) (opts, data []byte) {
+	n := DataOffset(h) - len(h)
+	if n > len(rest) {
+		return nil, nil
+	}
+	return rest[:n], rest[n:]
+}
+
+// MSSOption is the maximum segment size option for a SYN (rfc 9293
+// 3.7.1), 4 bytes so no padding is needed.
+func MSSOption(mss uint16) []byte {
+	return []byte{optMSS, 4, byte(mss >> 8), byte(mss)}
+}
+
+// GetMSS finds the mss option. unknown options are skipped by their
+// length byte.
+func GetMSS(opts []byte) (uint16, bool) {
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case optEnd:
+			return 0, false
+		case optNop:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return 0, false // broken
+		}
+		if opts[i] == optMSS && opts[i+1] == 4 {
+			return uint16(opts[i+2])<<8 | uint16(opts[i+3]), true
+		}
+		i += int(opts[i+1])
+	}
+	return 0, false
+}
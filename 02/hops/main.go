@@ -0,0 +1,159 @@
+// sends a tcpsim connection across the routers of a topology file: an
+// echo over several hops, a traceroute made of SYNs with a growing ttl,
+// and dials to addresses the routers can't reach.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"tcp-sim/ip"
+	"tcp-sim/pcap"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	topo := flag.String("topology", "topologies/line.conf", "topology file")
+	from := flag.String("from", "a", "host that dials")
+	to := flag.String("to", "b", "host that listens, empty for none")
+	port := flag.Int("port", 9000, "tcp port the listener uses")
+	external := flag.Bool("external", false, "the routers already run, from go run ./router")
+	capture := flag.String("capture", "", "pcap file for the dialing host's segments")
+	flag.Parse()
+
+	t, err := ip.LoadTopology(*topo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var routers []*ip.Router
+	if !*external {
+		for _, name := range t.Routers() {
+			r, err := ip.NewRouter(t, name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer r.Close()
+			routers = append(routers, r)
+		}
+	}
+	src, err := t.Host(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := tcpsim.Options{Host: src, MSL: 50 * time.Millisecond}
+	if *capture != "" {
+		if opts.Capture, err = pcap.Create(*capture); err != nil {
+			log.Fatal(err)
+		}
+		defer opts.Capture.Close()
+	}
+
+	if *to != "" {
+		dst, err := t.Host(*to)
+		if err != nil {
+			log.Fatal(err)
+		}
+		addr := fmt.Sprintf("%v:%d", dst.IP, *port)
+		l := listen(dst, addr)
+		defer l.Close()
+		echo(opts, addr)
+		traceroute(opts, addr)
+	}
+	for _, addr := range flag.Args() {
+		fmt.Printf("== dial %s ==\n", addr)
+		d := tcpsim.Dialer{Options: opts}
+		if c, err := d.Dial(addr); err != nil {
+			fmt.Printf("%s: %v\n", *from, err)
+		} else {
+			fmt.Printf("%s: connected?\n", *from)
+			c.Close()
+		}
+		wait(opts)
+	}
+
+	for _, r := range routers {
+		s := r.Stats()
+		fmt.Printf("%s: forwarded %d  ttl exceeded %d  no route %d  too big %d  bad %d  icmp sent %d\n",
+			r.Name(), s.Forwarded, s.TTLExceeded, s.NoRoute, s.TooBig, s.Bad, s.ICMPSent)
+	}
+}
+
+// listen starts an echo server on host h.
+func listen(h *ip.Host, addr string) net.Listener {
+	lc := tcpsim.ListenConfig{Options: tcpsim.Options{Host: h}}
+	l, err := lc.Listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func echo(opts tcpsim.Options, addr string) {
+	fmt.Printf("== echo %s -> %s ==\n", opts.Host.IP, addr)
+	d := tcpsim.Dialer{Options: opts}
+	c, err := d.Dial(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	msg := []byte("hello over the routers")
+	start := time.Now()
+	c.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%v: got %q back after %v\n", c.LocalAddr(), buf, time.Since(start).Round(10*time.Microsecond))
+	c.Close()
+	wait(opts)
+}
+
+// traceroute dials with ttl 1, 2, 3... every router where the SYN runs
+// out answers with time exceeded, until a SYN gets through.
+func traceroute(opts tcpsim.Options, addr string) {
+	fmt.Printf("== traceroute %s ==\n", addr)
+	for ttl := 1; ttl <= 16; ttl++ {
+		h := *opts.Host
+		h.TTL = ttl
+		d := tcpsim.Dialer{Options: opts}
+		d.Host = &h
+		start := time.Now()
+		c, err := d.Dial(addr)
+		took := time.Since(start).Round(10 * time.Microsecond)
+		var icmp *ip.ICMPError
+		switch {
+		case err == nil:
+			fmt.Printf("%2d  %v  %v  connected\n", ttl, c.RemoteAddr(), took)
+			c.Close()
+			wait(opts)
+			return
+		case errors.As(err, &icmp) && errors.Is(err, ip.ErrTimeExceeded):
+			fmt.Printf("%2d  %v  %v\n", ttl, icmp.From, took)
+		default:
+			fmt.Printf("%2d  %v\n", ttl, err)
+			return
+		}
+	}
+}
+
+// wait lets the conn leave TIME_WAIT, the next dial needs the host's
+// socket.
+func wait(opts tcpsim.Options) {
+	time.Sleep(3 * opts.MSL)
+}
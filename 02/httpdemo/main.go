@@ -0,0 +1,62 @@
+// net/http over the simulated tcp, to show tcpsim behaves like net.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	if len(os.Args) != 3 || (os.Args[1] != "server" && os.Args[1] != "client") {
+		fmt.Println("Usage:", "go run ./httpdemo server|client <port>")
+		os.Exit(1)
+	}
+	addr := "127.0.0.1:" + os.Args[2]
+
+	if os.Args[1] == "server" {
+		serve(addr)
+	} else {
+		fetch(addr)
+	}
+}
+
+func serve(addr string) {
+	l, err := tcpsim.Listen(addr)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Serving http on %s\n", addr)
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("%s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		// big enough to need many segments
+		fmt.Fprintf(w, "hello over simulated tcp\n%s\n", strings.Repeat("x", 20000))
+	})
+	panic(http.Serve(l, nil))
+}
+
+func fetch(addr string) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tcpsim.Dial(addr)
+		},
+	}}
+
+	resp, err := client.Get("http://" + addr + "/")
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("%s, %d bytes\n%s", resp.Status, len(body), body[:25])
+}
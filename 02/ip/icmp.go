@@ -0,0 +1,116 @@
+package ip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// icmp types and codes (rfc 792)
+const (
+	icmpUnreachable  = 3
+	icmpTimeExceeded = 11
+
+	codeNet      = 0
+	codeHost     = 1
+	codeFragNeed = 4 // too big for the next hop and don't fragment is set
+)
+
+var (
+	ErrTimeExceeded    = errors.New("time to live exceeded")
+	ErrNetUnreachable  = errors.New("network unreachable")
+	ErrHostUnreachable = errors.New("host unreachable")
+	ErrFragNeeded      = errors.New("fragmentation needed")
+)
+
+// ICMPError is an icmp error a router sent back about one of our
+// datagrams. it unwraps to ErrTimeExceeded, ErrNetUnreachable,
+// ErrHostUnreachable or ErrFragNeeded.
+type ICMPError struct {
+	Err  error
+	From net.IP // the router that sent it
+	MTU  int    // with ErrFragNeeded: what the next hop takes (rfc 1191)
+	// the datagram it is about: its destination and, from the first 8
+	// bytes of the tcp header, the ports
+	Dst              net.IP
+	SrcPort, DstPort uint16
+}
+
+func (e *ICMPError) Error() string {
+	if e.MTU > 0 {
+		return fmt.Sprintf("%v from %v, mtu %d (to %v:%d)", e.Err, e.From, e.MTU, e.Dst, e.DstPort)
+	}
+	return fmt.Sprintf("%v from %v (to %v:%d)", e.Err, e.From, e.Dst, e.DstPort)
+}
+
+func (e *ICMPError) Unwrap() error {
+	return e.Err
+}
+
+// icmp builds the payload of an icmp error about orig, the datagram that
+// caused it: type, code, checksum, 4 bytes that are unused except for the
+// mtu of fragmentation needed, then orig's header and the first 8 bytes
+// after it.
+func icmp(typ, code byte, mtu int, orig []byte) []byte {
+	n := min(len(orig), len(Header{})+8)
+	b := make([]byte, 8+n)
+	b[0] = typ
+	b[1] = code
+	binary.BigEndian.PutUint16(b[6:], uint16(mtu))
+	copy(b[8:], orig[:n])
+	binary.BigEndian.PutUint16(b[2:], checksum(b))
+	return b
+}
+
+// ParseICMP turns the payload of an icmp datagram from src into an
+// ICMPError. anything else (or a broken one) gives nil.
+func ParseICMP(src net.IP, b []byte) *ICMPError {
+	if len(b) < 8+len(Header{})+4 || checksum(b) != 0 {
+		return nil
+	}
+	e := &ICMPError{From: src}
+	switch {
+	case b[0] == icmpTimeExceeded:
+		e.Err = ErrTimeExceeded
+	case b[0] == icmpUnreachable && b[1] == codeNet:
+		e.Err = ErrNetUnreachable
+	case b[0] == icmpUnreachable && b[1] == codeHost:
+		e.Err = ErrHostUnreachable
+	case b[0] == icmpUnreachable && b[1] == codeFragNeed:
+		e.Err = ErrFragNeeded
+		e.MTU = int(binary.BigEndian.Uint16(b[6:]))
+	default:
+		return nil
+	}
+	var orig Header
+	copy(orig[:], b[8:])
+	e.Dst = GetDst(&orig)
+	tcp := b[8+len(orig):]
+	e.SrcPort = binary.BigEndian.Uint16(tcp[0:])
+	e.DstPort = binary.BigEndian.Uint16(tcp[2:])
+	return e
+}
+
+// isError reports if the datagram is an icmp error itself. nobody sends
+// an icmp error about one of those (rfc 1122 3.2.2).
+func isError(h *Header, payload []byte) bool {
+	return GetProto(h) == ProtoICMP && len(payload) > 0 &&
+		(payload[0] == icmpUnreachable || payload[0] == icmpTimeExceeded)
+}
+
+// checksum is the internet checksum of b. over a message with its
+// checksum filled in it is 0.
+func checksum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
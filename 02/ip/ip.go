@@ -0,0 +1,96 @@
+// Package ip is a small simulated ipv4 layer. hosts put a Header in front
+// of the tcp segment and send it to their gateway over udp, routers pass
+// it on with their static routing table until it reaches the host with
+// the destination address. the addresses are made up (like 10.0.1.2), the
+// real udp addresses of the hops come from a Topology.
+package ip
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Header is an ipv4 header without options (rfc 791).
+type Header [20]byte
+
+const ( // protocols
+	ProtoICMP = 1
+	ProtoTCP  = 6
+)
+
+const DefaultTTL = 64
+
+var ErrBadHeader = errors.New("not an ipv4 header, or a wrong checksum")
+
+// New makes the header for a datagram with n bytes of payload. the
+// checksum is filled in.
+func New(src, dst net.IP, proto byte, ttl int, n int) Header {
+	var h Header
+	h[0] = 0x45 // version 4, 5 words
+	binary.BigEndian.PutUint16(h[2:], uint16(len(h)+n))
+	binary.BigEndian.PutUint16(h[6:], 0x4000) // don't fragment, we never do
+	h[8] = byte(ttl)
+	h[9] = proto
+	copy(h[12:16], src.To4())
+	copy(h[16:20], dst.To4())
+	SetChecksum(&h)
+	return h
+}
+
+// Parse splits a datagram into header and payload. it fails on anything
+// that is not a 20 byte ipv4 header with the right checksum and length.
+func Parse(b []byte) (Header, []byte, error) {
+	var h Header
+	if len(b) < len(h) {
+		return h, nil, ErrBadHeader
+	}
+	copy(h[:], b)
+	n := int(GetLen(&h))
+	if h[0] != 0x45 || n < len(h) || n > len(b) || !ValidChecksum(&h) {
+		return h, nil, ErrBadHeader
+	}
+	return h, b[len(h):n], nil
+}
+
+func GetLen(h *Header) uint16 {
+	return binary.BigEndian.Uint16(h[2:])
+}
+
+func GetTTL(h *Header) int {
+	return int(h[8])
+}
+
+// SetTTL changes the ttl and fixes the checksum.
+func SetTTL(h *Header, ttl int) {
+	h[8] = byte(ttl)
+	SetChecksum(h)
+}
+
+func GetProto(h *Header) byte {
+	return h[9]
+}
+
+func GetSrc(h *Header) net.IP {
+	return net.IPv4(h[12], h[13], h[14], h[15])
+}
+
+func GetDst(h *Header) net.IP {
+	return net.IPv4(h[16], h[17], h[18], h[19])
+}
+
+// Checksum is the ones' complement of the ones' complement sum of the
+// header, with the checksum field as zero.
+func Checksum(h *Header) uint16 {
+	c := *h
+	c[10], c[11] = 0, 0
+	return checksum(c[:])
+}
+
+func SetChecksum(h *Header) {
+	binary.BigEndian.PutUint16(h[10:], Checksum(h))
+}
+
+func ValidChecksum(h *Header) bool {
+	return binary.BigEndian.Uint16(h[10:]) == Checksum(h)
+}
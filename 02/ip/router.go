@@ -0,0 +1,157 @@
+package ip
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"tcp-sim/netem"
+)
+
+const maxDatagram = 1500
+
+// RouterStats counts what a router did with the datagrams it got.
+type RouterStats struct {
+	Forwarded   int
+	TTLExceeded int // dropped with ttl 1 or 0, time exceeded sent back
+	NoRoute     int // dropped, unreachable sent back
+	TooBig      int // bigger than the mtu, dropped
+	Bad         int // not ipv4, or a wrong header checksum
+	Local       int // addressed to the router itself, dropped
+	ICMPSent    int
+}
+
+// Router forwards datagrams between the udp sockets of a topology.
+type Router struct {
+	node *Node
+	topo *Topology
+	conn *net.UDPConn
+	Link *netem.Link // optional, on the send side like a computer's
+
+	mu    sync.Mutex
+	stats RouterStats
+}
+
+// NewRouter binds the udp socket of the router called name and starts
+// forwarding.
+func NewRouter(t *Topology, name string) (*Router, error) {
+	n := t.Nodes[name]
+	if n == nil || !n.Router {
+		return nil, errors.New("no router " + name + " in the topology")
+	}
+	conn, err := net.ListenUDP("udp", n.Link)
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{node: n, topo: t, conn: conn}
+	go r.run()
+	return r, nil
+}
+
+func (r *Router) Name() string {
+	return r.node.Name
+}
+
+func (r *Router) Close() error {
+	return r.conn.Close()
+}
+
+// Stats returns a snapshot of the counters.
+func (r *Router) Stats() RouterStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+func (r *Router) count(f func(*RouterStats)) {
+	r.mu.Lock()
+	f(&r.stats)
+	r.mu.Unlock()
+}
+
+func (r *Router) run() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, _, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		r.forward(buf[:n])
+	}
+}
+
+// forward sends b one hop closer to its destination (rfc 1812 5.2).
+func (r *Router) forward(b []byte) {
+	h, payload, err := Parse(b)
+	if err != nil {
+		r.count(func(s *RouterStats) { s.Bad++ })
+		return
+	}
+	b = b[:GetLen(&h)]
+	if GetDst(&h).Equal(r.node.IP) {
+		r.count(func(s *RouterStats) { s.Local++ })
+		return
+	}
+	if GetTTL(&h) <= 1 {
+		r.count(func(s *RouterStats) { s.TTLExceeded++ })
+		r.icmpError(h, payload, b, icmpTimeExceeded, 0, 0)
+		return
+	}
+	next := r.topo.Lookup(r.node, GetDst(&h))
+	if next == nil {
+		r.count(func(s *RouterStats) { s.NoRoute++ })
+		r.icmpError(h, payload, b, icmpUnreachable, codeNet, 0)
+		return
+	}
+	if !next.Router && !next.IP.Equal(GetDst(&h)) {
+		// the route points at a host, but not the one it is for
+		r.count(func(s *RouterStats) { s.NoRoute++ })
+		r.icmpError(h, payload, b, icmpUnreachable, codeHost, 0)
+		return
+	}
+	if mtu := r.node.MTU; mtu > 0 && len(b) > mtu {
+		// we set don't fragment on everything, so it can only be
+		// dropped. a silent router doesn't even say why: a black hole
+		r.count(func(s *RouterStats) { s.TooBig++ })
+		if !r.node.Silent {
+			r.icmpError(h, payload, b, icmpUnreachable, codeFragNeed, mtu)
+		}
+		return
+	}
+
+	SetTTL(&h, GetTTL(&h)-1)
+	out := append(h[:len(h):len(h)], payload...)
+	r.count(func(s *RouterStats) { s.Forwarded++ })
+	r.send(out, next)
+}
+
+// icmpError tells the sender of orig why it went no further.
+func (r *Router) icmpError(h Header, payload, orig []byte, typ, code byte, mtu int) {
+	if isError(&h, payload) {
+		return // never about another icmp error, that could loop
+	}
+	src := GetSrc(&h)
+	next := r.topo.Lookup(r.node, src)
+	if next == nil {
+		return
+	}
+	msg := icmp(typ, code, mtu, orig)
+	ih := New(r.node.IP, src, ProtoICMP, DefaultTTL, len(msg))
+	r.count(func(s *RouterStats) { s.ICMPSent++ })
+	r.send(append(ih[:], msg...), next)
+}
+
+func (r *Router) send(b []byte, next *Node) {
+	write := func(b []byte) error {
+		_, err := r.conn.WriteToUDP(b, next.Link)
+		return err
+	}
+	if r.Link != nil {
+		r.Link.Send(b, write)
+		return
+	}
+	write(b)
+}
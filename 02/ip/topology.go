@@ -0,0 +1,193 @@
+package ip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Topology is the simulated network from a config file:
+//
+//	// a --- r1 --- r2 --- b
+//	host   a   10.0.1.2  127.0.0.1:7101  via r1
+//	router r1  10.0.1.1  127.0.0.1:7001
+//	router r2  10.0.2.1  127.0.0.1:7002
+//	host   b   10.0.2.2  127.0.0.1:7102  via r2
+//	route  r1  10.0.1.0/24  a
+//	route  r1  0.0.0.0/0    r2
+//	route  r2  10.0.2.2/32  b
+//	route  r2  10.0.1.0/24  r1
+//	mtu    r2  576
+//
+// every node has a simulated ip and the udp address it sends and receives
+// on. a host sends everything to the router after "via". a route sends
+// the destinations in a prefix to the named node, the longest prefix
+// wins. a router with an mtu drops bigger datagrams and sends back
+// fragmentation needed, or nothing with "mtu r2 576 silent".
+type Topology struct {
+	Nodes map[string]*Node
+}
+
+type Node struct {
+	Name   string
+	Router bool
+	IP     net.IP
+	Link   *net.UDPAddr // real udp address of the node
+	Routes []Route
+	MTU    int  // largest datagram a router sends on, 0 for any
+	Silent bool // no icmp when a datagram is too big
+}
+
+type Route struct {
+	Dst *net.IPNet
+	Via string // next hop
+}
+
+// Host is what a computer needs to send through the simulated network.
+type Host struct {
+	Name    string
+	IP      net.IP
+	Link    *net.UDPAddr // the udp socket of the host
+	Gateway *net.UDPAddr // where it sends everything
+	TTL     int          // 0 means DefaultTTL
+}
+
+// LoadTopology reads a topology file.
+func LoadTopology(path string) (*Topology, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := ParseTopology(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// ParseTopology reads a topology from r, see Topology for the format.
+func ParseTopology(r io.Reader) (*Topology, error) {
+	t := &Topology{Nodes: make(map[string]*Node)}
+	type pending struct {
+		num       int
+		node, via string
+		dst       *net.IPNet
+	}
+	var routes []pending
+
+	sc := bufio.NewScanner(r)
+	for num := 1; sc.Scan(); num++ {
+		text := sc.Text()
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i]
+		}
+		f := strings.Fields(text)
+		if len(f) == 0 {
+			continue
+		}
+		switch {
+		case f[0] == "router" && len(f) == 4, f[0] == "host" && len(f) == 6 && f[4] == "via":
+			if t.Nodes[f[1]] != nil {
+				return nil, fmt.Errorf("line %d: %s is there twice", num, f[1])
+			}
+			n := &Node{Name: f[1], Router: f[0] == "router", IP: net.ParseIP(f[2]).To4()}
+			if n.IP == nil {
+				return nil, fmt.Errorf("line %d: bad ipv4 address %q", num, f[2])
+			}
+			var err error
+			if n.Link, err = net.ResolveUDPAddr("udp", f[3]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", num, err)
+			}
+			t.Nodes[n.Name] = n
+			if f[0] == "host" {
+				_, all, _ := net.ParseCIDR("0.0.0.0/0")
+				routes = append(routes, pending{num, n.Name, f[5], all})
+			}
+		case f[0] == "mtu" && (len(f) == 3 || len(f) == 4 && f[3] == "silent"):
+			n := t.Nodes[f[1]]
+			if n == nil || !n.Router {
+				return nil, fmt.Errorf("line %d: no router %q, mtu lines go after it", num, f[1])
+			}
+			mtu, err := strconv.Atoi(f[2])
+			if err != nil || mtu < 68 {
+				return nil, fmt.Errorf("line %d: bad mtu %q, 68 at least", num, f[2])
+			}
+			n.MTU = mtu
+			n.Silent = len(f) == 4
+		case f[0] == "route" && len(f) == 4:
+			_, dst, err := net.ParseCIDR(f[2])
+			if err != nil || dst.IP.To4() == nil {
+				return nil, fmt.Errorf("line %d: bad ipv4 prefix %q", num, f[2])
+			}
+			routes = append(routes, pending{num, f[1], f[3], dst})
+		default:
+			return nil, fmt.Errorf("line %d: want router <name> <ip> <udp addr>, host <name> <ip> <udp addr> via <router>, route <node> <prefix> <next hop> or mtu <router> <bytes> [silent]", num)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	// routes may name nodes that come later in the file
+	for _, r := range routes {
+		n, via := t.Nodes[r.node], t.Nodes[r.via]
+		switch {
+		case n == nil:
+			return nil, fmt.Errorf("line %d: no node %q", r.num, r.node)
+		case via == nil:
+			return nil, fmt.Errorf("line %d: no node %q", r.num, r.via)
+		case !n.Router && len(n.Routes) > 0:
+			return nil, fmt.Errorf("line %d: %s is a host, it only has its via", r.num, r.node)
+		case !n.Router && !via.Router:
+			return nil, fmt.Errorf("line %d: %s is a host, not a router", r.num, r.via)
+		}
+		n.Routes = append(n.Routes, Route{r.dst, r.via})
+	}
+	for _, n := range t.Nodes {
+		// longest prefix first, so the first match is the one
+		sort.SliceStable(n.Routes, func(i, j int) bool {
+			a, _ := n.Routes[i].Dst.Mask.Size()
+			b, _ := n.Routes[j].Dst.Mask.Size()
+			return a > b
+		})
+	}
+	return t, nil
+}
+
+// Lookup returns the next hop from n towards dst, nil if n has no route.
+func (t *Topology) Lookup(n *Node, dst net.IP) *Node {
+	for _, r := range n.Routes {
+		if r.Dst.Contains(dst) {
+			return t.Nodes[r.Via]
+		}
+	}
+	return nil
+}
+
+// Routers returns the names of all routers, sorted.
+func (t *Topology) Routers() []string {
+	var names []string
+	for name, n := range t.Nodes {
+		if n.Router {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Host returns the host called name, ready for computer.Config.
+func (t *Topology) Host(name string) (*Host, error) {
+	n := t.Nodes[name]
+	if n == nil || n.Router {
+		return nil, fmt.Errorf("no host %q in the topology", name)
+	}
+	gw := t.Nodes[n.Routes[0].Via]
+	return &Host{Name: n.Name, IP: n.IP, Link: n.Link, Gateway: gw.Link}, nil
+}
@@ -0,0 +1,69 @@
+// Package isn picks initial sequence numbers the way rfc 6528 says:
+//
+//	ISN = M + F(localip, localport, remoteip, remoteport, secretkey)
+//
+// M is a timer that ticks every 4 microseconds and F is a keyed hash of
+// the 4-tuple. someone who sees the ISNs of their own connections learns
+// nothing about the ISN of another 4-tuple, and for one 4-tuple the ISNs
+// keep climbing with the clock, so they only come back after M wraps,
+// about 4.7 hours later, way past the 2 minute MSL.
+package isn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Tick is how often M goes up by one.
+const Tick = 4 * time.Microsecond
+
+// Generator makes ISNs with its own secret key.
+type Generator struct {
+	secret [32]byte
+	now    func() time.Time
+}
+
+// New returns a generator with a random secret, using the real clock.
+func New() *Generator {
+	g := &Generator{now: time.Now}
+	rand.Read(g.secret[:])
+	return g
+}
+
+// NewWithClock is New with a fixed secret and a clock of your own, so a
+// test can step time by hand.
+func NewWithClock(secret []byte, now func() time.Time) *Generator {
+	g := &Generator{now: now}
+	copy(g.secret[:], secret)
+	return g
+}
+
+// ISN returns the initial sequence number for a connection from local to
+// remote.
+func (g *Generator) ISN(local, remote *net.UDPAddr) uint32 {
+	m := uint32(g.now().UnixNano() / int64(Tick))
+	return m + g.hash(local, remote)
+}
+
+func (g *Generator) hash(local, remote *net.UDPAddr) uint32 {
+	mac := hmac.New(sha256.New, g.secret[:])
+	mac.Write(local.IP.To16())
+	mac.Write(remote.IP.To16())
+	var b [4]byte
+	binary.BigEndian.PutUint16(b[0:], uint16(local.Port))
+	binary.BigEndian.PutUint16(b[2:], uint16(remote.Port))
+	mac.Write(b[:])
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+var std = New()
+
+// Generate returns the ISN for local to remote from the process wide
+// generator.
+func Generate(local, remote *net.UDPAddr) uint32 {
+	return std.ISN(local, remote)
+}
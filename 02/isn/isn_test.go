@@ -0,0 +1,96 @@
+package isn
+
+import (
+	"math/rand/v2"
+	"net"
+	"testing"
+	"time"
+)
+
+const msl = 2 * time.Minute
+
+var server = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+// generator is what the attacker is up against.
+type generator interface {
+	ISN(local, remote *net.UDPAddr) uint32
+}
+
+// counter is the rfc 793 generator: M alone, the same for every 4-tuple.
+type counter struct {
+	now func() time.Time
+}
+
+func (c counter) ISN(local, remote *net.UDPAddr) uint32 {
+	return uint32(c.now().UnixNano() / int64(Tick))
+}
+
+// guesses has the attacker connect from its port, see the server's ISN,
+// and guess the ISN the server gives the victim a little later from the
+// time in between alone. it returns how many guesses were within window.
+func guesses(g generator, now *time.Time, trials int, window uint32) int {
+	hits := 0
+	for i := 0; i < trials; i++ {
+		attacker := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1024 + rand.IntN(60000)}
+		victim := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1024 + rand.IntN(60000)}
+		seen := g.ISN(server, attacker)
+		elapsed := time.Duration(rand.IntN(1000)) * time.Microsecond
+		*now = now.Add(elapsed)
+		actual := g.ISN(server, victim)
+
+		if d := actual - (seen + uint32(elapsed/Tick)); d <= window || -d <= window {
+			hits++
+		}
+		*now = now.Add(time.Millisecond)
+	}
+	return hits
+}
+
+func TestUnpredictable(t *testing.T) {
+	const trials = 10000
+	const window = 65535 // a guess this close counts, like a receive window
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+
+	// the same attack works every time on a plain counter
+	if hits := guesses(counter{clock}, &now, trials, window); hits != trials {
+		t.Fatalf("counter: %d of %d guesses hit, want all of them", hits, trials)
+	}
+
+	g := New()
+	g.now = clock
+	hits := guesses(g, &now, trials, window)
+	// chance of a random hit is about 2*window/2^32 per guess
+	expected := float64(trials) * 2 * window / (1 << 32)
+	if float64(hits) > 10*expected+3 {
+		t.Fatalf("rfc 6528: %d of %d guesses hit, %.1f expected by luck", hits, trials, expected)
+	}
+}
+
+// TestNoRepeatWithinMSL connects on one 4-tuple every millisecond for
+// twice the msl, the longest a TIME_WAIT lasts.
+func TestNoRepeatWithinMSL(t *testing.T) {
+	if wrap := time.Duration(1<<32) * Tick; wrap <= 2*msl {
+		t.Fatalf("M wraps after %v, within 2*MSL", wrap)
+	}
+
+	now := time.Unix(1700000000, 0)
+	g := NewWithClock([]byte("secret"), func() time.Time { return now })
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+
+	seen := make(map[uint32]time.Duration)
+	prev := g.ISN(server, client)
+	seen[prev] = 0
+	for at := time.Millisecond; at <= 2*msl; at += time.Millisecond {
+		now = now.Add(time.Millisecond)
+		n := g.ISN(server, client)
+		if first, dup := seen[n]; dup {
+			t.Fatalf("ISN %d came back after %v, first at %v", n, at, first)
+		}
+		if int32(n-prev) <= 0 {
+			t.Fatalf("ISN %d at %v is not past %d", n, at, prev)
+		}
+		seen[n] = at
+		prev = n
+	}
+}
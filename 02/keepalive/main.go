@@ -0,0 +1,160 @@
+// shows keepalive finding a dead peer, and a listener reaping conns that
+// stay idle.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"tcp-sim/netem"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	idle := flag.Duration("idle", time.Second, "keepalive: quiet time before the first probe")
+	interval := flag.Duration("interval", 300*time.Millisecond, "keepalive: time between probes")
+	count := flag.Int("count", 3, "keepalive: unanswered probes before giving up")
+	timeout := flag.Duration("idle-timeout", 2*time.Second, "listener: reset conns idle this long")
+	flag.Parse()
+
+	ka := net.KeepAliveConfig{Enable: true, Idle: *idle, Interval: *interval, Count: *count}
+	ok := deadPeer(ka)
+	ok = reaping(ka, *timeout) && ok
+	if !ok {
+		fmt.Println("FAIL")
+		return
+	}
+	fmt.Println("PASS")
+}
+
+// deadPeer cuts the links under an established conn. only keepalive
+// can notice, nothing is being sent.
+func deadPeer(ka net.KeepAliveConfig) bool {
+	fmt.Println("== dead peer ==")
+	serverLink, clientLink := &netem.Link{}, &netem.Link{}
+	var lc tcpsim.ListenConfig
+	lc.Link = serverLink
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Write([]byte("hello"))
+		}
+	}()
+
+	var d tcpsim.Dialer
+	d.Link = clientLink
+	d.KeepAlive = ka
+	conn, err := d.Dial(l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 64)
+	n, _ := conn.Read(buf)
+	fmt.Printf("client: got %q, now the server host dies\n", buf[:n])
+	serverLink.SetDown(true)
+	clientLink.SetDown(true)
+
+	start := time.Now()
+	_, err = conn.Read(buf)
+	took := time.Since(start)
+	s := conn.(*tcpsim.Conn).Stats()
+	fmt.Printf("client: read failed after %v: %v\n", took.Round(10*time.Millisecond), err)
+	fmt.Printf("client: %d keepalive probes, state %s\n", s.KeepAliveProbes, s.State)
+
+	want := ka.Idle + time.Duration(ka.Count)*ka.Interval
+	return errors.Is(err, syscall.ETIMEDOUT) && s.KeepAliveProbes == ka.Count &&
+		took > want-ka.Interval && took < want+ka.Interval
+}
+
+// reaping opens three conns to a listener with an idle timeout: one
+// chats, one only sends keepalives and one says nothing. keepalives are
+// no data, so only the chatty one survives.
+func reaping(ka net.KeepAliveConfig, timeout time.Duration) bool {
+	fmt.Println("== idle reaping ==")
+	lc := tcpsim.ListenConfig{IdleTimeout: timeout}
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	serverErr := make(chan error, 3)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 64)
+				for {
+					if _, err := c.Read(buf); err != nil {
+						serverErr <- err
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	names := []string{"chatty", "keepalive", "quiet"}
+	errs := make(chan error, len(names))
+	stop := make(chan struct{})
+	for _, name := range names {
+		var d tcpsim.Dialer
+		if name == "keepalive" {
+			d.KeepAlive = ka
+			d.KeepAlive.Idle = timeout / 4
+		}
+		conn, err := d.Dial(l.Addr().String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		go func() {
+			if name == "chatty" {
+				t := time.NewTicker(timeout / 3)
+				defer t.Stop()
+				for {
+					select {
+					case <-t.C:
+						conn.Write([]byte("still here"))
+					case <-stop:
+						errs <- nil
+						return
+					}
+				}
+			}
+			_, err := conn.Read(make([]byte, 64))
+			fmt.Printf("%s client: %v\n", name, err)
+			errs <- err
+		}()
+	}
+
+	time.Sleep(timeout * 3 / 2)
+	close(stop)
+	ok := true
+	for range names {
+		err := <-errs
+		ok = ok && (err == nil || errors.Is(err, syscall.ECONNRESET))
+	}
+	for range 2 {
+		err := <-serverErr
+		fmt.Printf("server: %v\n", err)
+		ok = ok && errors.Is(err, syscall.ECONNABORTED)
+	}
+	s := l.(*tcpsim.Listener).Stats()
+	fmt.Printf("listener: reaped %d\n", s.Reaped)
+	return ok && s.Reaped == 2
+}
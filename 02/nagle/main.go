@@ -0,0 +1,167 @@
+// runs two interactive workloads with Nagle and delayed ACKs on and off,
+// and counts the segments and ACKs each combination sends.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"tcp-sim/netem"
+	"tcp-sim/tcpsim"
+)
+
+type result struct {
+	latency        time.Duration // average per keystroke or request
+	client, server tcpsim.Stats
+}
+
+func main() {
+	delay := flag.Duration("delay", 20*time.Millisecond, "one-way delay of the link")
+	keys := flag.Int("keys", 100, "keystrokes typed")
+	every := flag.Duration("every", 5*time.Millisecond, "time between keystrokes")
+	requests := flag.Int("requests", 10, "write-write-read requests")
+	flag.Parse()
+
+	fmt.Printf("typing: %d one byte writes %v apart, echoed by the server\n", *keys, *every)
+	header()
+	for _, o := range combos() {
+		r := run(o, *delay, func(c net.Conn) time.Duration { return typing(c, *keys, *every) }, echo)
+		row(o, r)
+	}
+
+	fmt.Printf("\nwrite-write-read: %d requests sent as a 100 byte header and a 100 byte body\n", *requests)
+	header()
+	for _, o := range combos() {
+		r := run(o, *delay, func(c net.Conn) time.Duration { return writeWriteRead(c, *requests) }, respond)
+		row(o, r)
+	}
+}
+
+func combos() []tcpsim.Options {
+	var all []tcpsim.Options
+	for _, nagle := range []bool{false, true} {
+		for _, delack := range []bool{false, true} {
+			all = append(all, tcpsim.Options{Nagle: nagle, DelayedAck: delack})
+		}
+	}
+	return all
+}
+
+func header() {
+	fmt.Println("nagle  delack  client segs  data  acks  server segs  data  acks  delayed  avg latency")
+}
+
+func row(o tcpsim.Options, r result) {
+	fmt.Printf("%-5s  %-6s  %11d  %4d  %4d  %11d  %4d  %4d  %7d  %v\n",
+		onOff(o.Nagle), onOff(o.DelayedAck),
+		r.client.SegmentsSent, r.client.DataSegmentsSent, r.client.AcksSent,
+		r.server.SegmentsSent, r.server.DataSegmentsSent, r.server.AcksSent,
+		r.client.DelayedAcks+r.server.DelayedAcks, r.latency.Round(100*time.Microsecond))
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// run connects a client and a server that both use o and returns the
+// stats of both once the client is done.
+func run(o tcpsim.Options, delay time.Duration, client func(net.Conn) time.Duration, server func(net.Conn)) result {
+	lc := tcpsim.ListenConfig{Options: o}
+	lc.Link = &netem.Link{Delay: delay}
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *tcpsim.Conn)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		accepted <- c.(*tcpsim.Conn)
+		server(c)
+	}()
+
+	d := tcpsim.Dialer{Options: o}
+	d.Link = &netem.Link{Delay: delay}
+	conn, err := d.Dial(l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := <-accepted
+	var r result
+	r.latency = client(conn)
+	r.client = conn.(*tcpsim.Conn).Stats()
+	r.server = srv.Stats()
+	conn.Close()
+	return r
+}
+
+// typing writes one byte at a time, like a telnet session, and measures
+// how long each takes to come back.
+func typing(c net.Conn, keys int, every time.Duration) time.Duration {
+	sent := make([]time.Time, keys)
+	done := make(chan time.Duration)
+	go func() {
+		var total time.Duration
+		buf := make([]byte, keys)
+		for got := 0; got < keys; {
+			n, err := c.Read(buf)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for i := got; i < got+n; i++ {
+				total += time.Since(sent[i])
+			}
+			got += n
+		}
+		done <- total / time.Duration(keys)
+	}()
+	for i := range keys {
+		sent[i] = time.Now()
+		if _, err := c.Write([]byte{'a'}); err != nil {
+			log.Fatal(err)
+		}
+		time.Sleep(every)
+	}
+	return <-done
+}
+
+func echo(c net.Conn) {
+	io.Copy(c, c)
+}
+
+// writeWriteRead sends each request in two writes and waits for the
+// answer, the pattern that makes Nagle and delayed ACKs wait on each
+// other.
+func writeWriteRead(c net.Conn, requests int) time.Duration {
+	start := time.Now()
+	part := make([]byte, 100)
+	resp := make([]byte, 10)
+	for range requests {
+		c.Write(part) // header
+		c.Write(part) // body
+		if _, err := io.ReadFull(c, resp); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return time.Since(start) / time.Duration(requests)
+}
+
+func respond(c net.Conn) {
+	req := make([]byte, 200)
+	for {
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		c.Write(make([]byte, 10))
+	}
+}
@@ -0,0 +1,112 @@
+// Package netem makes the loopback network worse on purpose: it drops and
+// delays datagrams on the send side, so retransmission and congestion
+// control have something to do.
+package netem
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Link describes the path one computer sends on. the zero value is a
+// perfect link.
+type Link struct {
+	Loss   float64       // chance a datagram is dropped, 0 to 1
+	Delay  time.Duration // one-way delay added to every datagram
+	Jitter time.Duration // extra random delay, 0 to Jitter
+	// Reorder is the chance a datagram is held back for ReorderDelay on
+	// top of the rest, so the ones sent after it overtake it.
+	Reorder      float64
+	ReorderDelay time.Duration // 0 means 10ms
+	// MTU is the largest datagram the link carries, 0 for any. bigger
+	// ones are dropped without a word, like a path with an icmp filter.
+	MTU int
+	// Seed makes the random drops, jitter and reordering repeat from
+	// run to run, for comparing settings under the same losses. 0 uses
+	// the global source.
+	Seed int64
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
+
+	down  atomic.Bool // cable pulled, see SetDown
+	once  sync.Once
+	mu    sync.Mutex
+	last  time.Time // due time of the newest queued datagram
+	queue chan delayed
+}
+
+type delayed struct {
+	due   time.Time
+	b     []byte
+	write func([]byte) error
+}
+
+// Send passes b to write, or drops it, or hands it to write after Delay
+// plus jitter. delayed datagrams keep their order, except the ones picked
+// by Reorder.
+func (l *Link) Send(b []byte, write func([]byte) error) error {
+	if l.down.Load() || l.MTU > 0 && len(b) > l.MTU {
+		return nil
+	}
+	if l.Loss > 0 && l.float() < l.Loss {
+		return nil // lost on the way, the sender can't tell
+	}
+	if l.Reorder > 0 && l.float() < l.Reorder {
+		hold := l.ReorderDelay
+		if hold <= 0 {
+			hold = 10 * time.Millisecond
+		}
+		b = append([]byte(nil), b...)
+		time.AfterFunc(l.Delay+hold, func() { write(b) })
+		return nil
+	}
+	if l.Delay <= 0 && l.Jitter <= 0 {
+		return write(b)
+	}
+
+	l.once.Do(func() {
+		l.queue = make(chan delayed, 4096)
+		go l.run()
+	})
+	due := time.Now().Add(l.Delay)
+	if l.Jitter > 0 {
+		due = due.Add(time.Duration(l.float() * float64(l.Jitter)))
+	}
+	l.mu.Lock()
+	if due.Before(l.last) {
+		due = l.last // never overtake the one before
+	}
+	l.last = due
+	l.queue <- delayed{due, append([]byte(nil), b...), write}
+	l.mu.Unlock()
+	return nil
+}
+
+// float is a random number in [0, 1), from Seed if there is one.
+func (l *Link) float() float64 {
+	if l.Seed == 0 {
+		return rand.Float64()
+	}
+	l.rngMu.Lock()
+	defer l.rngMu.Unlock()
+	if l.rng == nil {
+		l.rng = rand.New(rand.NewSource(l.Seed))
+	}
+	return l.rng.Float64()
+}
+
+// SetDown drops every datagram while down is true, like a crashed host
+// or a pulled cable. nothing tells the sender.
+func (l *Link) SetDown(down bool) {
+	l.down.Store(down)
+}
+
+func (l *Link) run() {
+	for d := range l.queue {
+		time.Sleep(time.Until(d.due))
+		d.write(d.b)
+	}
+}
@@ -0,0 +1,144 @@
+// Package pcap writes the simulated tcp segments to a classic .pcap file.
+// each segment gets a made up ipv4 or ipv6 header in front, so wireshark
+// decodes it as real tcp instead of a udp payload.
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"tcp-sim/header"
+)
+
+const linkTypeRaw = 101 // packets start with the ip header, no ethernet
+
+// Writer appends packets to a pcap file. it is safe for concurrent use.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+	id uint16 // ipv4 identification, counts up
+}
+
+// NewWriter writes the pcap file header to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4) // magic, microsecond timestamps
+	binary.LittleEndian.PutUint16(hdr[4:], 2)          // version 2.4
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535) // snaplen
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// Create makes the file at path and writes the pcap header.
+func Create(path string) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Close closes the underlying file, if it is one. a nil Writer is fine.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// WriteSegment records one tcp segment (header plus payload) going from
+// src to dst. a nil Writer records nothing.
+func (w *Writer) WriteSegment(src, dst *net.UDPAddr, seg []byte) error {
+	if w == nil || len(seg) < 20 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	srcIP, dstIP := ip(src), ip(dst)
+	var pkt []byte
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		w.id++
+		pkt = make([]byte, 20+len(seg))
+		hdr := pkt[:20]
+		hdr[0] = 0x45 // ipv4, 5 words
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(hdr[4:], w.id)
+		binary.BigEndian.PutUint16(hdr[6:], 0x4000) // don't fragment
+		hdr[8] = 64                                 // ttl
+		hdr[9] = 6                                  // tcp
+		copy(hdr[12:16], src4)
+		copy(hdr[16:20], dst4)
+		binary.BigEndian.PutUint16(hdr[10:], ^sum(hdr))
+	} else {
+		pkt = make([]byte, 40+len(seg))
+		hdr := pkt[:40]
+		hdr[0] = 0x60 // ipv6, no traffic class or flow label
+		binary.BigEndian.PutUint16(hdr[4:], uint16(len(seg)))
+		hdr[6] = 6  // next header: tcp
+		hdr[7] = 64 // hop limit
+		copy(hdr[8:24], srcIP.To16())
+		copy(hdr[24:40], dstIP.To16())
+	}
+
+	tcp := pkt[len(pkt)-len(seg):]
+	copy(tcp, seg)
+	if tcp[12]>>4 == 0 {
+		tcp[12] = 5 << 4 // our headers leave the data offset empty
+	}
+	header.SetChecksum(tcp, srcIP, dstIP)
+
+	now := time.Now()
+	var rec [16]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	if _, err := w.w.Write(rec[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(pkt)
+	return err
+}
+
+// ip gives the address to put in the packet, loopback for anything that
+// has none (a socket bound to all interfaces).
+func ip(a *net.UDPAddr) net.IP {
+	switch {
+	case a == nil:
+		return net.IPv4(127, 0, 0, 1)
+	case a.IP.IsUnspecified() && a.IP.To4() == nil:
+		return net.IPv6loopback
+	case a.IP.IsUnspecified():
+		return net.IPv4(127, 0, 0, 1)
+	}
+	return a.IP
+}
+
+// sum is the 16 bit ones' complement sum of the ipv4 header checksum.
+func sum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
@@ -0,0 +1,59 @@
+// a symmetric peer: both sides dial each other, nobody listens. started
+// at about the same time their SYNs cross and they do a simultaneous
+// open. they swap a line, close at the same time and sit in TIME_WAIT.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	msl := flag.Duration("msl", 5*time.Second, "maximum segment lifetime, TIME_WAIT is twice this")
+	flag.Usage = func() {
+		fmt.Println("Usage:", "go run ./peer [-msl 5s] <my-port> <peer-port>")
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	me, other := flag.Arg(0), flag.Arg(1)
+
+	// until the other peer runs our SYN is refused, keep sending it
+	d := tcpsim.Dialer{LocalAddr: "127.0.0.1:" + me, RetryRefused: true}
+	d.MSL = *msl
+	c, err := d.Dial("127.0.0.1:" + other)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	conn := c.(*tcpsim.Conn)
+	fmt.Printf("Connected %s -> %s, simultaneous open: %v\n",
+		conn.LocalAddr(), conn.RemoteAddr(), conn.Stats().SimultaneousOpen)
+
+	fmt.Fprintf(conn, "hello from port %s\n", me)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Print("Got: ", line)
+
+	conn.Close()
+	start := time.Now()
+	state := ""
+	for state != "CLOSED" {
+		s := conn.Stats()
+		if s.State != state {
+			state = s.State
+			fmt.Printf("%6dms  %s\n", time.Since(start).Milliseconds(), state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
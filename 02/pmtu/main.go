@@ -0,0 +1,166 @@
+// shows the mss options in the SYNs, and path mtu discovery: a transfer
+// over a path that drops big datagrams, once with an icmp that says so
+// and once silently, a black hole. without Options.PMTUD the conn just
+// times out.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"tcp-sim/ip"
+	"tcp-sim/netem"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	size := flag.Int("size", 64*1024, "bytes per transfer")
+	mtu := flag.Int("mtu", 576, "mtu of the small link")
+	topo := flag.String("topology", "topologies/line.conf", "topology file, r2 gets the small mtu")
+	flag.Parse()
+
+	negotiate()
+
+	// the datagrams on a plain udp link are the bare segments, no ip
+	// header
+	fmt.Printf("== udp link that drops datagrams over %d bytes ==\n", *mtu)
+	for _, pmtud := range []bool{true, false} {
+		d := tcpsim.Dialer{Options: options(pmtud)}
+		d.Link = &netem.Link{MTU: *mtu}
+		l := sink(tcpsim.ListenConfig{}, "127.0.0.1:0", *size)
+		transfer(name("black hole", pmtud), d, l.Addr().String(), *size)
+		l.Close()
+	}
+
+	t, err := ip.LoadTopology(*topo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.Nodes["r2"].MTU = *mtu
+	a, err := t.Host("a")
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := t.Host("b")
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := fmt.Sprintf("%v:9000", b.IP)
+	l := sink(tcpsim.ListenConfig{Options: tcpsim.Options{Host: b}}, addr, *size)
+	defer l.Close()
+
+	fmt.Printf("== routers, r2 has mtu %d ==\n", *mtu)
+	for _, c := range []struct {
+		what          string
+		silent, pmtud bool
+	}{
+		{"frag needed", false, true},
+		{"black hole", true, true},
+		{"frag needed", false, false}, // last, it keeps a's socket until it times out
+	} {
+		t.Nodes["r2"].Silent = c.silent
+		routers := start(t) // after the change, they read the topology
+		d := tcpsim.Dialer{Options: options(c.pmtud)}
+		d.Host = a
+		transfer(name(c.what, c.pmtud), d, addr, *size)
+		time.Sleep(3 * d.MSL) // TIME_WAIT, the next dial needs a's socket
+		for _, r := range routers {
+			r.Close()
+			if s := r.Stats(); s.TooBig > 0 {
+				fmt.Printf("%-26s %s: too big %d  icmp sent %d\n", "", r.Name(), s.TooBig, s.ICMPSent)
+			}
+		}
+	}
+}
+
+func start(t *ip.Topology) []*ip.Router {
+	var routers []*ip.Router
+	for _, name := range t.Routers() {
+		r, err := ip.NewRouter(t, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		routers = append(routers, r)
+	}
+	return routers
+}
+
+func options(pmtud bool) tcpsim.Options {
+	return tcpsim.Options{
+		PMTUD:  pmtud,
+		MinRTO: 50 * time.Millisecond,
+		MaxRTO: 200 * time.Millisecond, // so the stuck ones give up soon
+		MSL:    50 * time.Millisecond,
+	}
+}
+
+func name(what string, pmtud bool) string {
+	if pmtud {
+		return what + ", pmtud"
+	}
+	return what + ", no pmtud"
+}
+
+// negotiate dials with a smaller mss than the listener's: both send
+// segments of the smaller one.
+func negotiate() {
+	fmt.Println("== mss options ==")
+	l := sink(tcpsim.ListenConfig{}, "127.0.0.1:0", 0)
+	defer l.Close()
+	var d tcpsim.Dialer
+	d.MSS = 536
+	c, err := d.Dial(l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := c.(*tcpsim.Conn).Stats()
+	fmt.Printf("client: sent mss 536, peer sent %d, segments of %d\n", s.PeerMSS, s.MSS)
+	c.Close()
+}
+
+// sink accepts conns that send size bytes, and answers "ok" once they
+// are all there.
+func sink(lc tcpsim.ListenConfig, addr string, size int) net.Listener {
+	l, err := lc.Listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if _, err := io.CopyN(io.Discard, c, int64(size)); err == nil {
+					c.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func transfer(what string, d tcpsim.Dialer, addr string, size int) {
+	start := time.Now()
+	c, err := d.Dial(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(make([]byte, size))
+	_, err = io.ReadFull(c, make([]byte, 2))
+	took := time.Since(start).Round(time.Millisecond)
+	s := c.(*tcpsim.Conn).Stats()
+	if err != nil {
+		fmt.Printf("%-26s failed after %v: %v\n", what, took, err)
+	} else {
+		fmt.Printf("%-26s %d bytes in %v\n", what, size, took)
+	}
+	fmt.Printf("%-26s mss %d  reductions %d  black holes %d  timeouts %d\n", "", s.MSS, s.MSSReductions, s.BlackHoles, s.Timeouts)
+}
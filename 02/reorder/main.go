@@ -0,0 +1,94 @@
+// sends random data over a link that reorders and drops datagrams and
+// checks that what arrives is the same bytes in the same order. the ISNs
+// start just below 2^32 so the seqs wrap during the transfer.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"tcp-sim/netem"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	reorder := flag.Float64("reorder", 0.1, "chance each datagram is held back and overtaken")
+	hold := flag.Duration("hold", 15*time.Millisecond, "how long a reordered datagram is held back")
+	loss := flag.Float64("loss", 0.01, "chance each datagram is dropped")
+	delay := flag.Duration("delay", 5*time.Millisecond, "one-way delay")
+	size := flag.Int("bytes", 1<<20, "bytes to send")
+	flag.Parse()
+
+	link := func() *netem.Link {
+		return &netem.Link{Loss: *loss, Delay: *delay, Reorder: *reorder, ReorderDelay: *hold}
+	}
+	nearWrap := func(local, remote *net.UDPAddr) uint32 {
+		return 0xFFFFFFFF - uint32(rand.Intn(64<<10))
+	}
+
+	var lc tcpsim.ListenConfig
+	lc.Link = link()
+	lc.ISN = nearWrap
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	type result struct {
+		sum   [32]byte
+		n     int
+		stats tcpsim.Stats
+	}
+	done := make(chan result)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		h := sha256.New()
+		n, _ := io.Copy(h, conn)
+		var r result
+		copy(r.sum[:], h.Sum(nil))
+		r.n = int(n)
+		r.stats = conn.(*tcpsim.Conn).Stats()
+		conn.Close()
+		done <- r
+	}()
+
+	var d tcpsim.Dialer
+	d.Link = link()
+	d.ISN = nearWrap
+	conn, err := d.Dial(l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := conn.(*tcpsim.Conn)
+
+	data := make([]byte, *size)
+	rand.Read(data)
+	start := time.Now()
+	go func() {
+		c.Write(data)
+		c.Close()
+	}()
+
+	r := <-done
+	s := c.Stats()
+	fmt.Printf("sent %d bytes in %v\n", *size, time.Since(start).Round(time.Millisecond))
+	fmt.Printf("sender:   fast retransmits %d  timeouts %d\n", s.FastRetransmits, s.Timeouts)
+	fmt.Printf("receiver: out of order segments %d  still queued %d bytes\n", r.stats.OutOfOrder, r.stats.Reassembly)
+
+	want := sha256.Sum256(data)
+	if r.n != *size || !bytes.Equal(r.sum[:], want[:]) {
+		log.Fatalf("FAIL: got %d bytes, sha256 %x, want %x", r.n, r.sum[:8], want[:8])
+	}
+	fmt.Printf("PASS: %d bytes arrived in order, sha256 %x\n", r.n, want[:8])
+}
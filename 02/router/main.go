@@ -0,0 +1,49 @@
+// runs the routers of a topology file, all of them or the named ones, and
+// prints their counters when they change.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"tcp-sim/ip"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: go run ./router <topology> [router...]")
+		os.Exit(2)
+	}
+	t, err := ip.LoadTopology(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := os.Args[2:]
+	if len(names) == 0 {
+		names = t.Routers()
+	}
+
+	var routers []*ip.Router
+	for _, name := range names {
+		r, err := ip.NewRouter(t, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer r.Close()
+		fmt.Printf("%s: forwarding on %v\n", name, t.Nodes[name].Link)
+		routers = append(routers, r)
+	}
+
+	last := make([]ip.RouterStats, len(routers))
+	for range time.Tick(time.Second) {
+		for i, r := range routers {
+			if s := r.Stats(); s != last[i] {
+				fmt.Printf("%s: forwarded %d  ttl exceeded %d  no route %d  bad %d  icmp sent %d\n",
+					r.Name(), s.Forwarded, s.TTLExceeded, s.NoRoute, s.Bad, s.ICMPSent)
+				last[i] = s
+			}
+		}
+	}
+}
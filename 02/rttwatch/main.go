@@ -0,0 +1,81 @@
+// sends data over an emulated link and prints the sender's rtt estimates
+// while they converge.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"tcp-sim/netem"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	delay := flag.Duration("delay", 20*time.Millisecond, "one-way delay")
+	jitter := flag.Duration("jitter", 0, "extra random one-way delay, 0 to jitter")
+	loss := flag.Float64("loss", 0, "chance each datagram is dropped")
+	size := flag.Int("bytes", 1<<20, "bytes to send")
+	every := flag.Duration("every", 250*time.Millisecond, "how often to print")
+	flag.Parse()
+
+	link := func() *netem.Link {
+		return &netem.Link{Delay: *delay, Jitter: *jitter, Loss: *loss}
+	}
+
+	var lc tcpsim.ListenConfig
+	lc.Link = link()
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+
+	var d tcpsim.Dialer
+	d.Link = link()
+	conn, err := d.Dial(l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := conn.(*tcpsim.Conn)
+
+	done := make(chan struct{})
+	go func() {
+		c.Write(make([]byte, *size))
+		close(done)
+	}()
+
+	fmt.Printf("delay %v jitter %v loss %.3f, true rtt is about %v\n", *delay, *jitter, *loss, 2**delay+*jitter)
+	fmt.Printf("%8s %8s %10s %10s %10s %10s %8s\n", "time", "samples", "last", "srtt", "rttvar", "rto", "timeouts")
+	start := time.Now()
+	tick := time.NewTicker(*every)
+	defer tick.Stop()
+	for {
+		s := c.Stats()
+		fmt.Printf("%8v %8d %10v %10v %10v %10v %8d\n", time.Since(start).Round(time.Millisecond),
+			s.RTTSamples, r(s.LastRTT), r(s.SRTT), r(s.RTTVar), r(s.RTO), s.Timeouts)
+		select {
+		case <-done:
+			if s.InFlight == 0 {
+				conn.Close()
+				return
+			}
+		default:
+		}
+		<-tick.C
+	}
+}
+
+func r(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
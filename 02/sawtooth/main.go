@@ -0,0 +1,72 @@
+// sends data over a lossy link and writes the sender's cwnd and ssthresh
+// as csv, to plot the congestion control sawtooth.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"tcp-sim/netem"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	ccName := flag.String("cc", "reno", "congestion control: reno or cubic")
+	loss := flag.Float64("loss", 0.01, "chance each datagram is dropped")
+	delay := flag.Duration("delay", 10*time.Millisecond, "one-way delay")
+	size := flag.Int("bytes", 4<<20, "bytes to send")
+	out := flag.String("out", "cwnd.csv", "csv file for the trace")
+	flag.Parse()
+
+	cc, err := tcpsim.CongestionByName(*ccName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	// the receiver only acks, so it gets the delay but no loss
+	var lc tcpsim.ListenConfig
+	lc.Link = &netem.Link{Delay: *delay}
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan int64)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, _ := io.Copy(io.Discard, conn)
+		conn.Close()
+		done <- n
+	}()
+
+	var d tcpsim.Dialer
+	d.Congestion = cc
+	d.Trace = tcpsim.NewTrace(f)
+	d.Link = &netem.Link{Loss: *loss, Delay: *delay}
+	conn, err := d.Dial(l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now()
+	conn.Write(make([]byte, *size))
+	conn.Close()
+	n := <-done
+	elapsed := time.Since(start)
+
+	fmt.Printf("%s: %d bytes in %v (%.0f KB/s), trace in %s\n",
+		*ccName, n, elapsed.Round(time.Millisecond), float64(n)/1024/elapsed.Seconds(), *out)
+}
@@ -0,0 +1,47 @@
+// runs packetdrill style scripts against tcpsim: each script injects
+// crafted segments into a listening or dialing stack and checks every
+// segment it sends back, and when. see script.go for the format.
+//
+//	go run ./scenario scenario/scripts/*.pkt
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func main() {
+	tolerance := flag.Duration("tolerance", 0, "timing tolerance, overrides the scripts' set tolerance")
+	flag.Usage = func() {
+		fmt.Println("Usage:", "go run ./scenario [-tolerance 25ms] <script.pkt>...")
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	failed := 0
+	for _, path := range flag.Args() {
+		s, err := parseFile(path)
+		if err == nil {
+			if *tolerance > 0 {
+				s.set.tolerance = *tolerance
+			}
+			start := time.Now()
+			err = run(s)
+			if err == nil {
+				fmt.Printf("PASS %s (%v)\n", path, time.Since(start).Round(time.Millisecond))
+				continue
+			}
+		}
+		fmt.Printf("FAIL %s: %v\n", path, err)
+		failed++
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d failed\n", failed, flag.NArg())
+		os.Exit(1)
+	}
+}
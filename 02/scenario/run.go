@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"tcp-sim/computer"
+	"tcp-sim/header"
+	"tcp-sim/tcpsim"
+)
+
+// runner plays the remote peer. it has its own udp socket, sends the "<"
+// segments from it and checks what the stack under test sends to it.
+type runner struct {
+	s     *script
+	udp   *net.UDPConn
+	start time.Time
+	in    chan received
+
+	stack *net.UDPAddr // the stack's socket, known after listen or its first segment
+	l     *tcpsim.Listener
+	conn  chan *tcpsim.Conn // from accept or connect
+	c     *tcpsim.Conn
+	bg    chan error // errors of accept, connect and write, which run in the background
+
+	sndNxt uint32 // our next seq, the default for "<"
+	rcvNxt uint32 // after the stack's last segment, the default ack for "<"
+}
+
+type received struct {
+	h       header.Header
+	opts    []byte
+	payload []byte
+	from    *net.UDPAddr
+	at      time.Time
+}
+
+func run(s *script) error {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	r := &runner{
+		s:    s,
+		udp:  udp,
+		in:   make(chan received, 256),
+		conn: make(chan *tcpsim.Conn, 1),
+		bg:   make(chan error, 16),
+	}
+	go r.readLoop()
+	defer r.cleanup()
+
+	r.start = time.Now()
+	for _, l := range s.lines {
+		if err := r.step(l); err != nil {
+			return fmt.Errorf("line %d: %v", l.num, err)
+		}
+	}
+	// nothing more may come out of the stack
+	time.Sleep(2 * s.set.tolerance)
+	return r.unexpected()
+}
+
+func (r *runner) cleanup() {
+	if r.c != nil {
+		r.c.Close()
+	}
+	if r.l != nil {
+		r.l.Close()
+	}
+	r.udp.Close()
+}
+
+func (r *runner) readLoop() {
+	for {
+		buf := make([]byte, computer.MaxDatagram)
+		n, from, err := r.udp.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		var h header.Header
+		if n < len(h) {
+			continue
+		}
+		copy(h[:], buf)
+		opts, payload := header.SplitOptions(&h, buf[len(h):n])
+		r.in <- received{h, opts, payload, from, time.Now()}
+	}
+}
+
+func (r *runner) options() tcpsim.Options {
+	isn := r.s.set.isn
+	return tcpsim.Options{
+		ISN:        func(local, remote *net.UDPAddr) uint32 { return isn },
+		MSL:        r.s.set.msl,
+		MinRTO:     r.s.set.minRTO,
+		RecvWindow: r.s.set.rcvWindow,
+		KeepAlive:  r.s.set.keepAlive,
+		Nagle:      r.s.set.nagle,
+		DelayedAck: r.s.set.delAck,
+		MSS:        r.s.set.mss,
+	}
+}
+
+func (r *runner) step(l line) error {
+	due := r.start.Add(l.at)
+	if l.cmd == ">" {
+		return r.expect(l.seg, due)
+	}
+
+	time.Sleep(time.Until(due))
+	if err := r.unexpected(); err != nil {
+		return err
+	}
+	select {
+	case err := <-r.bg:
+		return err
+	default:
+	}
+
+	switch l.cmd {
+	case "<":
+		return r.inject(l.seg)
+	case "listen":
+		lc := tcpsim.ListenConfig{Options: r.options()}
+		ln, err := lc.Listen("127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		r.l = ln.(*tcpsim.Listener)
+		// it listens on all interfaces, we reach it on loopback
+		r.stack = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: r.l.Addr().(*net.UDPAddr).Port}
+	case "connect":
+		d := tcpsim.Dialer{Options: r.options()}
+		go func() {
+			c, err := d.Dial(r.udp.LocalAddr().String())
+			if err != nil {
+				r.bg <- fmt.Errorf("connect: %v", err)
+				return
+			}
+			r.conn <- c.(*tcpsim.Conn)
+		}()
+	case "accept":
+		if r.l == nil {
+			return fmt.Errorf("accept before listen")
+		}
+		go func() {
+			c, err := r.l.Accept()
+			if err != nil {
+				r.bg <- fmt.Errorf("accept: %v", err)
+				return
+			}
+			r.conn <- c.(*tcpsim.Conn)
+		}()
+	case "write":
+		c, err := r.established()
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(l.arg)
+		if err != nil {
+			return fmt.Errorf("bad byte count %q", l.arg)
+		}
+		go func() {
+			if _, err := c.Write(make([]byte, n)); err != nil {
+				r.bg <- fmt.Errorf("write: %v", err)
+			}
+		}()
+	case "read":
+		c, err := r.established()
+		if err != nil {
+			return err
+		}
+		return r.read(c, l.arg)
+	case "close":
+		c, err := r.established()
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	return nil
+}
+
+// established waits a little for the conn that accept or connect will
+// hand over.
+func (r *runner) established() (*tcpsim.Conn, error) {
+	if r.c != nil {
+		return r.c, nil
+	}
+	select {
+	case r.c = <-r.conn:
+		return r.c, nil
+	case err := <-r.bg:
+		return nil, err
+	case <-time.After(r.s.set.tolerance):
+		return nil, fmt.Errorf("no connection, missing accept or connect?")
+	}
+}
+
+func (r *runner) read(c *tcpsim.Conn, arg string) error {
+	c.SetReadDeadline(time.Now().Add(r.s.set.tolerance))
+	defer c.SetReadDeadline(time.Time{})
+	switch arg {
+	case "eof":
+		n, err := c.Read(make([]byte, 1))
+		if err != io.EOF {
+			return fmt.Errorf("read: want EOF, got %d bytes, %v", n, err)
+		}
+		return nil
+	case "error": // the conn was reset or timed out
+		n, err := c.Read(make([]byte, 1))
+		if err == nil || err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("read: want an error, got %d bytes, %v", n, err)
+		}
+		return nil
+	}
+	want, err := strconv.Atoi(arg)
+	if err != nil {
+		return fmt.Errorf("bad byte count %q", arg)
+	}
+	n, err := io.ReadFull(c, make([]byte, want))
+	if err != nil {
+		return fmt.Errorf("read: want %d bytes, got %d: %v", want, n, err)
+	}
+	return nil
+}
+
+// inject sends a "<" segment to the stack.
+func (r *runner) inject(seg segment) error {
+	if r.stack == nil {
+		return fmt.Errorf("nothing to send to yet, the stack has not listened or sent anything")
+	}
+	var h header.Header
+	h[13] = seg.flags
+	seq := r.sndNxt
+	if seg.seq != nil {
+		seq = *seg.seq
+	}
+	header.SetSeq(&h, seq)
+	if seg.flags&header.ACK != 0 {
+		ack := r.rcvNxt
+		if seg.ack != nil {
+			ack = *seg.ack
+		}
+		header.SetAckNum(&h, ack)
+	}
+	win := uint16(65535)
+	if seg.win != nil {
+		win = *seg.win
+	}
+	header.SetWindow(&h, win)
+	header.FillPorts(&h, r.udp, r.stack.Port)
+
+	var opts []byte
+	if seg.mss != nil {
+		opts = header.MSSOption(*seg.mss)
+		header.SetDataOffset(&h, len(h)+len(opts))
+	}
+	out := append(append(h[:], opts...), make([]byte, seg.len)...)
+	header.SetChecksum(out, r.udp.LocalAddr().(*net.UDPAddr).IP, r.stack.IP)
+
+	r.sndNxt = seq + seqLen(h, seg.len)
+	_, err := r.udp.WriteToUDP(out, r.stack)
+	return err
+}
+
+// expect waits for the stack's next segment and checks it against seg and
+// the time it was due.
+func (r *runner) expect(seg segment, due time.Time) error {
+	tol := r.s.set.tolerance
+	var got received
+	for wait := true; wait; {
+		select {
+		case got = <-r.in:
+			wait = !r.fromStack(got)
+		case err := <-r.bg:
+			return err
+		case <-time.After(time.Until(due.Add(tol))):
+			return fmt.Errorf("want %s at %v, nothing came", seg, r.since(due))
+		}
+	}
+	if got.at.Before(due.Add(-tol)) {
+		return fmt.Errorf("got %s at %v, want it at %v", describe(got), r.since(got.at), r.since(due))
+	}
+	if r.stack == nil {
+		r.stack = got.from
+	}
+
+	h := got.h
+	ok := h[13] == seg.flags &&
+		(seg.seq == nil || *seg.seq == header.GetSeq(&h)) &&
+		(seg.ack == nil || *seg.ack == header.GetAckNum(&h)) &&
+		(seg.win == nil || *seg.win == header.GetWindow(&h)) &&
+		(!seg.lenOK || seg.len == len(got.payload))
+	if seg.mss != nil {
+		mss, has := header.GetMSS(got.opts)
+		ok = ok && has && mss == *seg.mss
+	}
+	if !ok {
+		return fmt.Errorf("got %s, want %s", describe(got), seg)
+	}
+	if n := seqLen(h, len(got.payload)); n > 0 {
+		r.rcvNxt = header.GetSeq(&h) + n
+	}
+	return nil
+}
+
+// unexpected fails if the stack sent something no ">" line asked for.
+func (r *runner) unexpected() error {
+	for {
+		select {
+		case got := <-r.in:
+			if r.fromStack(got) {
+				return fmt.Errorf("unexpected %s at %v", describe(got), r.since(got.at))
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// fromStack drops segments from anyone but the stack under test, like a
+// conn of an earlier script that still sends to our reused port.
+func (r *runner) fromStack(got received) bool {
+	return r.stack == nil || got.from.Port == r.stack.Port
+}
+
+func (r *runner) since(t time.Time) string {
+	return fmt.Sprintf("+%.3fs", t.Sub(r.start).Seconds())
+}
+
+// seqLen is how much sequence space a segment takes.
+func seqLen(h header.Header, n int) uint32 {
+	l := uint32(n)
+	if header.IsSyn(&h) {
+		l++
+	}
+	if header.IsFin(&h) {
+		l++
+	}
+	return l
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tcp-sim/computer"
+	"tcp-sim/header"
+)
+
+// a script is a list of timed lines, like packetdrill:
+//
+//	set isn 0                   // settings go before the first timed line
+//	0    listen
+//	+0   < S seq=100            // inject a segment into the stack
+//	+0   > S. seq=0 ack=101     // the stack must send this one
+//	+0.2 read 1000              // call into the conn
+//
+// a time with + is relative to the line before, without it is seconds
+// from the start. "." is the ACK flag.
+type script struct {
+	name  string
+	set   settings
+	lines []line
+}
+
+type settings struct {
+	isn       uint32
+	tolerance time.Duration
+	msl       time.Duration
+	minRTO    time.Duration
+	rcvWindow int
+	keepAlive net.KeepAliveConfig
+	nagle     bool
+	delAck    bool
+	mss       int
+}
+
+type line struct {
+	num int
+	at  time.Duration // from the start of the script
+	cmd string        // "<", ">", or a command like "listen"
+	arg string        // for commands: "1000" for write, "eof" for read
+	seg segment
+}
+
+// segment is a "<" or ">" line. fields left out of a ">" line are not
+// checked, the ones left out of a "<" line get defaults.
+type segment struct {
+	flags byte
+	seq   *uint32
+	ack   *uint32
+	win   *uint16
+	mss   *uint16 // the mss option, only on SYNs
+	len   int
+	lenOK bool // len= was given
+}
+
+var commands = map[string]bool{
+	"listen": true, "connect": true, "accept": true,
+	"write": true, "read": true, "close": true,
+}
+
+func parseFile(path string) (*script, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &script{name: path, set: settings{
+		tolerance: 25 * time.Millisecond,
+		msl:       500 * time.Millisecond,
+		minRTO:    200 * time.Millisecond,
+	}}
+	var now time.Duration
+	sc := bufio.NewScanner(f)
+	for num := 1; sc.Scan(); num++ {
+		text := sc.Text()
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "set" {
+			if len(s.lines) > 0 {
+				return nil, fmt.Errorf("%s:%d: set after the first timed line", path, num)
+			}
+			if err := s.set.parse(fields[1:]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, num, err)
+			}
+			continue
+		}
+
+		l, err := parseLine(fields, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, num, err)
+		}
+		l.num = num
+		now = l.at
+		s.lines = append(s.lines, l)
+	}
+	return s, sc.Err()
+}
+
+func (s *settings) parse(f []string) error {
+	if len(f) != 2 {
+		return fmt.Errorf("want set <name> <value>")
+	}
+	var err error
+	switch f[0] {
+	case "isn":
+		var n uint64
+		n, err = strconv.ParseUint(f[1], 10, 32)
+		s.isn = uint32(n)
+	case "tolerance":
+		s.tolerance, err = time.ParseDuration(f[1])
+	case "msl":
+		s.msl, err = time.ParseDuration(f[1])
+	case "minrto":
+		s.minRTO, err = time.ParseDuration(f[1])
+	case "rcvwnd":
+		s.rcvWindow, err = strconv.Atoi(f[1])
+	case "kaidle":
+		s.keepAlive.Enable = true
+		s.keepAlive.Idle, err = time.ParseDuration(f[1])
+	case "kainterval":
+		s.keepAlive.Interval, err = time.ParseDuration(f[1])
+	case "kacount":
+		s.keepAlive.Count, err = strconv.Atoi(f[1])
+	case "nagle":
+		s.nagle, err = onOff(f[1])
+	case "delack":
+		s.delAck, err = onOff(f[1])
+	case "mss":
+		s.mss, err = strconv.Atoi(f[1])
+	default:
+		return fmt.Errorf("unknown setting %q", f[0])
+	}
+	return err
+}
+
+func onOff(v string) (bool, error) {
+	switch v {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("want on or off, got %q", v)
+}
+
+func parseLine(f []string, prev time.Duration) (line, error) {
+	var l line
+	if len(f) < 2 {
+		return l, fmt.Errorf("want <time> <what>")
+	}
+
+	t := f[0]
+	rel := strings.HasPrefix(t, "+")
+	secs, err := strconv.ParseFloat(strings.TrimPrefix(t, "+"), 64)
+	if err != nil || secs < 0 {
+		return l, fmt.Errorf("bad time %q", t)
+	}
+	l.at = time.Duration(secs * float64(time.Second))
+	if rel {
+		l.at += prev
+	} else if l.at < prev {
+		return l, fmt.Errorf("time %q goes back", t)
+	}
+
+	l.cmd = f[1]
+	switch {
+	case l.cmd == "<" || l.cmd == ">":
+		l.seg, err = parseSegment(f[2:])
+	case commands[l.cmd]:
+		if len(f) > 3 {
+			return l, fmt.Errorf("too many arguments for %s", l.cmd)
+		}
+		if len(f) == 3 {
+			l.arg = f[2]
+		}
+		if (l.cmd == "write" || l.cmd == "read") && l.arg == "" {
+			return l, fmt.Errorf("%s needs a byte count", l.cmd)
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", l.cmd)
+	}
+	return l, err
+}
+
+func parseSegment(f []string) (segment, error) {
+	var s segment
+	if len(f) == 0 {
+		return s, fmt.Errorf("segment needs flags")
+	}
+	for _, c := range f[0] {
+		switch c {
+		case 'S':
+			s.flags |= header.SYN
+		case 'F':
+			s.flags |= header.FIN
+		case 'R':
+			s.flags |= header.RST
+		case '.':
+			s.flags |= header.ACK
+		default:
+			return s, fmt.Errorf("unknown flag %q", c)
+		}
+	}
+
+	for _, kv := range f[1:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return s, fmt.Errorf("want name=value, got %q", kv)
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return s, fmt.Errorf("bad number in %q", kv)
+		}
+		switch k {
+		case "seq":
+			seq := uint32(n)
+			s.seq = &seq
+		case "ack":
+			ack := uint32(n)
+			s.ack = &ack
+		case "win":
+			if n > 65535 {
+				return s, fmt.Errorf("win %d does not fit 16 bits", n)
+			}
+			win := uint16(n)
+			s.win = &win
+		case "mss":
+			if n > 65535 || s.flags&header.SYN == 0 {
+				return s, fmt.Errorf("mss %d: only a SYN has one, 16 bits", n)
+			}
+			mss := uint16(n)
+			s.mss = &mss
+		case "len":
+			if max := computer.MaxDatagram - len(header.Header{}); n > uint64(max) {
+				return s, fmt.Errorf("len %d does not fit a datagram, %d at most", n, max)
+			}
+			s.len = int(n)
+			s.lenOK = true
+		default:
+			return s, fmt.Errorf("unknown field %q", k)
+		}
+	}
+	return s, nil
+}
+
+// flagString writes flags the way scripts do, "S." for a SYN-ACK.
+func flagString(flags byte) string {
+	var b strings.Builder
+	for _, f := range []struct {
+		bit byte
+		c   byte
+	}{{header.SYN, 'S'}, {header.FIN, 'F'}, {header.RST, 'R'}, {header.ACK, '.'}} {
+		if flags&f.bit != 0 {
+			b.WriteByte(f.c)
+		}
+	}
+	return b.String()
+}
+
+// describe prints a segment from the stack the way scripts write it.
+func describe(got received) string {
+	h := got.h
+	var b strings.Builder
+	b.WriteString(flagString(h[13]))
+	fmt.Fprintf(&b, " seq=%d", header.GetSeq(&h))
+	if header.IsAck(&h) {
+		fmt.Fprintf(&b, " ack=%d", header.GetAckNum(&h))
+	}
+	fmt.Fprintf(&b, " win=%d", header.GetWindow(&h))
+	if mss, ok := header.GetMSS(got.opts); ok {
+		fmt.Fprintf(&b, " mss=%d", mss)
+	}
+	fmt.Fprintf(&b, " len=%d", len(got.payload))
+	return b.String()
+}
+
+// String prints the fields a ">" line checks.
+func (seg segment) String() string {
+	s := flagString(seg.flags)
+	if seg.seq != nil {
+		s += fmt.Sprintf(" seq=%d", *seg.seq)
+	}
+	if seg.ack != nil {
+		s += fmt.Sprintf(" ack=%d", *seg.ack)
+	}
+	if seg.win != nil {
+		s += fmt.Sprintf(" win=%d", *seg.win)
+	}
+	if seg.mss != nil {
+		s += fmt.Sprintf(" mss=%d", *seg.mss)
+	}
+	if seg.lenOK {
+		s += fmt.Sprintf(" len=%d", seg.len)
+	}
+	return s
+}
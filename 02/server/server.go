@@ -1,19 +1,48 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"tcp-sim/computer"
 	"tcp-sim/header"
 )
 
 func main() {
-	var s computer.Computer
-	s.HandleArgs()
-	s.Listen()
-	defer s.Conn.Close()
+	// exit only once run's defers closed the capture
+	if err := run(); err != nil {
+		if errors.Is(err, computer.ErrUsage) {
+			fmt.Println(computer.ErrUsage)
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg, err := computer.ParseArgs(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	defer cfg.Capture.Close()
+	s, err := computer.New(cfg)
+	if err != nil {
+		return err
+	}
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	defer s.Close()
+	fmt.Printf("Listening on %s\n", s.LocalAddr())
 
 	// wait for syn
-	syn, clientAddr := s.ReadHeader()
+	ctx := context.Background()
+	syn, clientAddr, err := s.ReadHeader(ctx)
+	if err != nil {
+		return err
+	}
 	if header.IsSyn(&syn) {
 		syn.Print("SERVER: RECEIVED SYN")
 	}
@@ -21,17 +50,23 @@ func main() {
 	// send synack
 	var synAck header.Header
 	header.SetSynAck(&synAck)
-	header.SetSeq(&synAck, s.Seq)
+	header.SetSeq(&synAck, s.ISN(clientAddr))
 	header.SetAckNum(&synAck, header.GetSeq(&syn)+1)
-	header.FillPorts(&synAck, s.Conn, int(header.GetSrcPort(&syn)))
+	header.FillPorts(&synAck, s.UDPConn(), int(header.GetSrcPort(&syn)))
 
-	s.SendHeader(synAck, clientAddr)
+	if err := s.SendHeader(synAck, clientAddr); err != nil {
+		return err
+	}
 	synAck.Print("SERVER: SENT SYNACK")
 
 	// receive ack
-	ack, _ := s.ReadHeader()
+	ack, _, err := s.ReadHeader(ctx)
+	if err != nil {
+		return err
+	}
 	if header.IsAck(&ack) {
 		ack.Print("SERVER: RECEIVED ACK")
 		fmt.Printf("\nHandshake complete.")
 	}
+	return nil
 }
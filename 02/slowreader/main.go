@@ -0,0 +1,83 @@
+// a receiver that does not read for a while and then reads slowly, to show
+// the sender stall on a zero window, probe it, and resume.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"tcp-sim/netem"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	window := flag.Int("window", 8192, "receive buffer of the slow reader")
+	pause := flag.Duration("pause", 3*time.Second, "how long the reader reads nothing")
+	chunk := flag.Int("chunk", 1024, "bytes per read after the pause")
+	every := flag.Duration("read-every", 50*time.Millisecond, "time between reads after the pause")
+	size := flag.Int("bytes", 32*1024, "bytes to send")
+	flag.Parse()
+
+	var lc tcpsim.ListenConfig
+	lc.RecvWindow = *window
+	lc.Link = &netem.Link{Delay: 10 * time.Millisecond}
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	read := make(chan int)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		time.Sleep(*pause)
+		fmt.Println("reader: starting to read")
+		buf := make([]byte, *chunk)
+		total := 0
+		for {
+			n, err := conn.Read(buf)
+			total += n
+			if err == io.EOF {
+				break
+			}
+			time.Sleep(*every)
+		}
+		conn.Close()
+		read <- total
+	}()
+
+	var d tcpsim.Dialer
+	d.Link = &netem.Link{Delay: 10 * time.Millisecond}
+	conn, err := d.Dial(l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := conn.(*tcpsim.Conn)
+
+	go func() {
+		c.Write(make([]byte, *size))
+		c.Close()
+	}()
+
+	fmt.Printf("%8s %8s %8s %8s %8s\n", "time", "sndwnd", "inflight", "unsent", "probes")
+	start := time.Now()
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case n := <-read:
+			fmt.Printf("reader: got all %d bytes after %v\n", n, time.Since(start).Round(time.Millisecond))
+			return
+		case <-tick.C:
+			s := c.Stats()
+			fmt.Printf("%8v %8d %8d %8d %8d\n", time.Since(start).Round(time.Millisecond),
+				s.SndWnd, s.InFlight, s.Unsent, s.ZeroWindowProbes)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// syn flood demo: a tcpsim server that prints its handshake counters, and
+// an attacker that floods it with SYNs from spoofed source ports and then
+// checks a real handshake still gets through.
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"tcp-sim/computer"
+	"tcp-sim/header"
+	"tcp-sim/tcpsim"
+)
+
+func main() {
+	if len(os.Args) != 4 || (os.Args[1] != "server" && os.Args[1] != "attack") {
+		fmt.Println("Usage:", "go run ./synflood server <port> cookies|nocookies")
+		fmt.Println("      ", "go run ./synflood attack <server-port> <syn-count>")
+		os.Exit(1)
+	}
+	if os.Args[1] == "server" {
+		serve(os.Args[2], os.Args[3] == "cookies")
+	} else {
+		count, err := strconv.Atoi(os.Args[3])
+		if err != nil {
+			panic(err)
+		}
+		attack(os.Args[2], count)
+	}
+}
+
+func serve(port string, cookies bool) {
+	lc := tcpsim.ListenConfig{SynBacklog: 64, Cookies: tcpsim.CookiesOff}
+	if cookies {
+		lc.Cookies = tcpsim.CookiesWhenFull
+	}
+	l, err := lc.Listen("127.0.0.1:" + port)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Listening on port %s, syn backlog %d, cookies %v\n", port, lc.SynBacklog, cookies)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Printf("Accepted %s\n", conn.RemoteAddr())
+			conn.Close()
+		}
+	}()
+
+	var last tcpsim.ListenerStats
+	for range time.Tick(time.Second) {
+		s := l.(*tcpsim.Listener).Stats()
+		if s != last {
+			fmt.Printf("half-open %d  syn dropped %d  cookies sent %d ok %d bad %d  established %d\n",
+				s.HalfOpen, s.SynDropped, s.CookiesSent, s.CookiesOK, s.CookiesBad, s.Established)
+			last = s
+		}
+	}
+}
+
+func attack(port string, count int) {
+	c, err := computer.New(computer.Config{Addr: port})
+	if err == nil {
+		err = c.Dial()
+	}
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	// the server answers the port in the header, not the udp port, so
+	// the SYN-ACKs go to ports nobody listens on
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		var syn header.Header
+		header.SetSyn(&syn)
+		header.SetSeq(&syn, rand.Uint32())
+		header.FillPorts(&syn, c.UDPConn(), c.RemoteAddr().Port)
+		header.SetSrcPort(&syn, uint16(1024+rand.Intn(65535-1024)))
+		c.SendHeader(syn, nil)
+	}
+	fmt.Printf("Sent %d spoofed SYNs in %v\n", count, time.Since(start))
+
+	start = time.Now()
+	conn, err := tcpsim.Dial("127.0.0.1:" + port)
+	if err != nil {
+		fmt.Printf("Real handshake failed: %v\n", err)
+		os.Exit(1)
+	}
+	conn.Close()
+	fmt.Printf("Real handshake complete in %v.\n", time.Since(start))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"tcp-sim/tcpsim"
+)
+
+type clientConfig struct {
+	addr      string
+	size      int64
+	arqs, ccs []string
+	window    int
+	repeat    int
+	timeout   time.Duration
+	link      linkFlags
+}
+
+// results is the json the client writes.
+type results struct {
+	Server  string    `json:"server"`
+	Started time.Time `json:"started"`
+	Link    linkJSON  `json:"link"`
+	Runs    []result  `json:"runs"`
+}
+
+type linkJSON struct {
+	Loss     float64 `json:"loss"`
+	DelayMs  float64 `json:"delay_ms"`
+	JitterMs float64 `json:"jitter_ms"`
+	Reorder  float64 `json:"reorder"`
+	Seed     int64   `json:"seed"`
+}
+
+type result struct {
+	ARQ    string `json:"arq"`
+	CC     string `json:"cc"`
+	Run    int    `json:"run"`
+	Size   int64  `json:"size_bytes"`
+	Window int    `json:"window_bytes,omitempty"`
+
+	CompletionMs   float64 `json:"completion_ms"`   // from ready to the server's report
+	GoodputMbps    float64 `json:"goodput_mbps"`    // what arrived, per completion time
+	ThroughputMbps float64 `json:"throughput_mbps"` // what was sent, retransmissions included
+
+	DataSegments     int     `json:"data_segments"`
+	Retransmits      int     `json:"retransmits"`
+	RetransmitRate   float64 `json:"retransmit_rate"` // retransmits per data segment
+	Timeouts         int     `json:"timeouts"`
+	FastRetransmits  int     `json:"fast_retransmits"`
+	ServerOutOfOrder int     `json:"server_out_of_order"`
+	RTT              rttJSON `json:"rtt"`
+
+	Err string `json:"error,omitempty"`
+}
+
+type rttJSON struct {
+	Samples int     `json:"samples"`
+	MinMs   float64 `json:"min_ms"`
+	MeanMs  float64 `json:"mean_ms"`
+	P50Ms   float64 `json:"p50_ms"`
+	P90Ms   float64 `json:"p90_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+func runClient(cfg clientConfig, out string) error {
+	res := results{
+		Server:  cfg.addr,
+		Started: time.Now(),
+		Link: linkJSON{
+			Loss:     cfg.link.loss,
+			DelayMs:  ms(cfg.link.delay),
+			JitterMs: ms(cfg.link.jitter),
+			Reorder:  cfg.link.reorder,
+			Seed:     cfg.link.seed,
+		},
+	}
+	// the table goes to stderr when the json takes stdout
+	table := os.Stdout
+	if out == "-" {
+		table = os.Stderr
+	}
+	fmt.Fprintf(table, "%-8s %-6s %4s %10s %12s %10s %10s %9s %9s %9s\n",
+		"arq", "cc", "run", "time", "goodput", "rexmit", "timeouts", "rtt p50", "rtt p90", "rtt p99")
+	for _, arq := range cfg.arqs {
+		for _, cc := range cfg.ccs {
+			// every combination gets the same seeds, so the same losses
+			for run := 0; run < cfg.repeat; run++ {
+				r := transfer(cfg, arq, cc, run)
+				res.Runs = append(res.Runs, r)
+				if r.Err != "" {
+					fmt.Fprintf(table, "%-8s %-6s %4d  %s\n", arq, cc, run, r.Err)
+					continue
+				}
+				fmt.Fprintf(table, "%-8s %-6s %4d %8.0fms %7.2fMbit/s %9.2f%% %10d %7.2fms %7.2fms %7.2fms\n",
+					arq, cc, run, r.CompletionMs, r.GoodputMbps, 100*r.RetransmitRate, r.Timeouts,
+					r.RTT.P50Ms, r.RTT.P90Ms, r.RTT.P99Ms)
+			}
+		}
+	}
+
+	w := os.Stdout
+	if out != "-" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+// transfer runs one test and never fails, errors end up in the result.
+func transfer(cfg clientConfig, arqName, ccName string, run int) result {
+	r := result{ARQ: arqName, CC: ccName, Run: run, Size: cfg.size, Window: cfg.window}
+	arq, err := tcpsim.ARQByName(arqName)
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+	cc, err := tcpsim.CongestionByName(ccName)
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+
+	var mu sync.Mutex
+	var rtts []time.Duration
+	var d tcpsim.Dialer
+	d.Link = cfg.link.link(run)
+	d.ARQ = arq
+	d.Congestion = cc
+	d.OnRTT = func(rtt time.Duration) {
+		mu.Lock()
+		rtts = append(rtts, rtt)
+		mu.Unlock()
+	}
+	nc, err := d.Dial(cfg.addr)
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+	c := nc.(*tcpsim.Conn)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(cfg.timeout))
+
+	br := bufio.NewReader(c)
+	rep, start, err := exchange(c, br, cfg, arqName)
+	took := time.Since(start)
+	s := c.Stats()
+	mu.Lock()
+	r.RTT = summarize(rtts)
+	mu.Unlock()
+
+	r.CompletionMs = ms(took)
+	r.DataSegments = s.DataSegmentsSent
+	r.Retransmits = s.Retransmits
+	if s.DataSegmentsSent > 0 {
+		r.RetransmitRate = float64(s.Retransmits) / float64(s.DataSegmentsSent)
+	}
+	r.Timeouts = s.Timeouts
+	r.FastRetransmits = s.FastRetransmits
+	r.ThroughputMbps = mbps(int64(s.BytesSent), took)
+	switch {
+	case err != nil:
+		r.Err = err.Error()
+	case rep.Err != "":
+		r.Err = "server: " + rep.Err
+	default:
+		r.GoodputMbps = mbps(rep.Bytes, took)
+		r.ServerOutOfOrder = rep.OutOfOrder
+	}
+	return r
+}
+
+// exchange sends the request, waits for ready, sends the data and reads
+// the report. start is when the data began.
+func exchange(c *tcpsim.Conn, br *bufio.Reader, cfg clientConfig, arq string) (report, time.Time, error) {
+	var rep report
+	start := time.Now()
+	if err := json.NewEncoder(c).Encode(request{Size: cfg.size, ARQ: arq, Window: cfg.window}); err != nil {
+		return rep, start, err
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return rep, start, err
+	}
+	if line != "ready\n" {
+		json.Unmarshal([]byte(line), &rep)
+		return rep, start, fmt.Errorf("server: %s", rep.Err)
+	}
+
+	start = time.Now()
+	buf := make([]byte, 64*1024)
+	for left := cfg.size; left > 0; {
+		n, err := c.Write(buf[:min(left, int64(len(buf)))])
+		if err != nil {
+			return rep, start, err
+		}
+		left -= int64(n)
+	}
+	line, err = br.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return rep, start, err
+	}
+	err = json.Unmarshal([]byte(line), &rep)
+	return rep, start, err
+}
+
+// summarize gives the nearest rank percentiles of the rtt samples.
+func summarize(rtts []time.Duration) rttJSON {
+	if len(rtts) == 0 {
+		return rttJSON{}
+	}
+	sorted := append([]time.Duration(nil), rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	pct := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		return ms(sorted[max(i, 0)])
+	}
+	return rttJSON{
+		Samples: len(sorted),
+		MinMs:   ms(sorted[0]),
+		MeanMs:  ms(sum / time.Duration(len(sorted))),
+		P50Ms:   pct(50),
+		P90Ms:   pct(90),
+		P99Ms:   pct(99),
+		MaxMs:   ms(sorted[len(sorted)-1]),
+	}
+}
@@ -0,0 +1,128 @@
+// tcpsim-perf measures transfers over tcpsim, like iperf: a server that
+// sinks data and a client that sends it and reports goodput, the
+// retransmission rate, rtt percentiles and the completion time as json.
+// the client can run every combination of arq and congestion control
+// under the same emulated losses.
+//
+//	go run ./tcpsim-perf -s -port 5201
+//	go run ./tcpsim-perf -c 127.0.0.1:5201 -size 4M -arq gbn,sr -cc reno,cubic -loss 0.01 -json out.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tcp-sim/netem"
+)
+
+// request is the first line a client sends, as json. the server answers
+// "ready" once it applied it, so no data arrives under the old settings.
+type request struct {
+	Size   int64  `json:"size"`
+	ARQ    string `json:"arq"`
+	Window int    `json:"window,omitempty"` // server's receive buffer, 0 for its own
+}
+
+// report is the server's json line once all the data is there.
+type report struct {
+	Bytes      int64   `json:"bytes"`
+	ElapsedMs  float64 `json:"elapsed_ms"` // from ready to the last byte
+	OutOfOrder int     `json:"out_of_order"`
+	AcksSent   int     `json:"acks_sent"`
+	Err        string  `json:"error,omitempty"`
+}
+
+// linkFlags is the emulated path for what this side sends: data from
+// the client, acks from the server.
+type linkFlags struct {
+	loss, reorder float64
+	delay, jitter time.Duration
+	seed          int64
+}
+
+func (f *linkFlags) register() {
+	flag.Float64Var(&f.loss, "loss", 0, "chance each datagram this side sends is dropped")
+	flag.DurationVar(&f.delay, "delay", 0, "one-way delay for what this side sends")
+	flag.DurationVar(&f.jitter, "jitter", 0, "extra random one-way delay, 0 to jitter")
+	flag.Float64Var(&f.reorder, "reorder", 0, "chance a datagram is held back and overtaken")
+	flag.Int64Var(&f.seed, "seed", 1, "random seed of the link, the same seed drops the same datagrams. 0 for a random one")
+}
+
+// link is a fresh link, so every run starts the random drops over.
+func (f *linkFlags) link(run int) *netem.Link {
+	seed := f.seed
+	if seed != 0 {
+		seed += int64(run)
+	}
+	return &netem.Link{Loss: f.loss, Delay: f.delay, Jitter: f.jitter, Reorder: f.reorder, Seed: seed}
+}
+
+func main() {
+	server := flag.Bool("s", false, "run the server")
+	port := flag.Int("port", 5201, "server: port to listen on")
+	host := flag.String("bind", "127.0.0.1", "server: address to listen on")
+	client := flag.String("c", "", "run the client against this server host:port")
+	size := flag.String("size", "1M", "client: bytes per transfer, with K or M")
+	arqs := flag.String("arq", "default", "client: comma separated arq modes: default, gbn, sr")
+	ccs := flag.String("cc", "reno", "client: comma separated congestion controls: reno, cubic")
+	window := flag.Int("window", 0, "receive buffer in bytes, up to 65535 (client: the server's for the test)")
+	repeat := flag.Int("repeat", 1, "client: runs of every combination")
+	timeout := flag.Duration("timeout", time.Minute, "client: give up on a transfer after this long")
+	out := flag.String("json", "-", "client: file for the json results, - for stdout")
+	var lf linkFlags
+	lf.register()
+	flag.Usage = func() {
+		fmt.Println("Usage:", "go run ./tcpsim-perf -s [-port 5201] [-window n] [link flags]")
+		fmt.Println("      ", "go run ./tcpsim-perf -c host:port [-size 1M] [-arq default,gbn,sr] [-cc reno,cubic] [-window n] [-repeat n] [-json file] [link flags]")
+		fmt.Println("link flags: -loss p -delay d -jitter d -reorder p -seed n")
+	}
+	flag.Parse()
+
+	switch {
+	case *server && *client == "":
+		serve(fmt.Sprintf("%s:%d", *host, *port), *window, lf)
+	case !*server && *client != "":
+		n, err := parseSize(*size)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cfg := clientConfig{
+			addr:    *client,
+			size:    n,
+			arqs:    strings.Split(*arqs, ","),
+			ccs:     strings.Split(*ccs, ","),
+			window:  *window,
+			repeat:  max(*repeat, 1),
+			timeout: *timeout,
+			link:    lf,
+		}
+		if err := runClient(cfg, *out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// parseSize reads 1024, 64K or 4M.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, strings.TrimSuffix(s, "M")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q, want bytes like 1024, 64K or 4M", s)
+	}
+	return n * mult, nil
+}
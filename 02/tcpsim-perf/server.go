@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"tcp-sim/tcpsim"
+)
+
+func serve(addr string, window int, lf linkFlags) {
+	var lc tcpsim.ListenConfig
+	lc.RecvWindow = window
+	lc.Link = lf.link(0) // the acks of all tests share it
+	l, err := lc.Listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Listening on %s\n", l.Addr())
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer c.Close()
+			if err := sink(c.(*tcpsim.Conn)); err != nil {
+				fmt.Printf("%v: %v\n", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// sink runs one test: the request, ready, then the data and the report.
+func sink(c *tcpsim.Conn) error {
+	br := bufio.NewReader(c)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return fmt.Errorf("bad request: %v", err)
+	}
+	arq, err := tcpsim.ARQByName(req.ARQ)
+	if err == nil {
+		err = c.SetARQ(arq)
+	}
+	if err == nil && req.Window > 0 {
+		err = c.SetReadBuffer(req.Window)
+	}
+	if err != nil {
+		json.NewEncoder(c).Encode(report{Err: err.Error()})
+		return err
+	}
+	if _, err := io.WriteString(c, "ready\n"); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	n, err := io.CopyN(io.Discard, br, req.Size)
+	elapsed := time.Since(start)
+	s := c.Stats()
+	rep := report{
+		Bytes:      n,
+		ElapsedMs:  ms(elapsed),
+		OutOfOrder: s.OutOfOrder,
+		AcksSent:   s.AcksSent,
+	}
+	if err != nil {
+		rep.Err = err.Error()
+	}
+	if err := json.NewEncoder(c).Encode(rep); err != nil {
+		return err
+	}
+	fmt.Printf("%v  arq %-7s  %d bytes in %v  %.2f Mbit/s  out of order %d\n",
+		c.RemoteAddr(), arq, n, elapsed.Round(time.Millisecond), mbps(n, elapsed), s.OutOfOrder)
+	return nil
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func mbps(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}
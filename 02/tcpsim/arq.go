@@ -0,0 +1,65 @@
+package tcpsim
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// ARQ says how a conn recovers lost segments, to compare the textbook
+// schemes. fast retransmit works the same in all of them.
+type ARQ int
+
+const (
+	// ARQDefault is tcp without sack: keep data that comes ahead of a
+	// gap, but send everything after the hole again on a timeout.
+	ARQDefault ARQ = iota
+	// GoBackN drops data that comes ahead of a gap, so the sender must
+	// send it all again, which it does on a timeout.
+	GoBackN
+	// SelectiveRepeat keeps data ahead of a gap, and a timeout resends
+	// only the oldest segment. every partial ack after it resends the
+	// next hole, like fast recovery does (rfc 6582).
+	SelectiveRepeat
+)
+
+var arqNames = [...]string{"default", "gbn", "sr"}
+
+func (a ARQ) String() string {
+	if a < 0 || int(a) >= len(arqNames) {
+		return fmt.Sprintf("ARQ(%d)", int(a))
+	}
+	return arqNames[a]
+}
+
+// ARQByName returns the mode for "default", "gbn" or "sr", for command
+// line flags.
+func ARQByName(name string) (ARQ, error) {
+	for i, n := range arqNames {
+		if n == name {
+			return ARQ(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown arq %q, want default, gbn or sr", name)
+}
+
+// SetARQ changes how c recovers lost segments, see ARQ.
+func (c *Conn) SetARQ(a ARQ) error {
+	if a < ARQDefault || a > SelectiveRepeat {
+		return c.opError("set", syscall.EINVAL)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.arq = a
+	return nil
+}
+
+// selectiveTimeout resends only the oldest unacked segment after a
+// timeout. the rest stays in flight, the receiver may have it. must hold
+// c.mu.
+func (c *Conn) selectiveTimeout() {
+	c.recovery = true
+	c.recover = c.sndMax
+	c.inflate = 0
+	c.retransmit()
+	c.armTimer(c.rtt.rto)
+}
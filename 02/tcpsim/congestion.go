@@ -0,0 +1,162 @@
+package tcpsim
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// CongestionControl decides how many bytes a sender may have in flight.
+// the conn does the dup ack counting, fast retransmit and the window
+// inflation during fast recovery (rfc 5681, 6582); the controller only
+// moves cwnd and ssthresh.
+type CongestionControl interface {
+	Name() string
+	Cwnd() int
+	Ssthresh() int
+	// OnAck is called for every ACK of new data outside fast recovery.
+	OnAck(acked int)
+	// OnLoss is called on 3 dup acks (timeout false) or when the
+	// retransmission timer fires.
+	OnLoss(inFlight int, timeout bool)
+	// SetMSS is called when the segment size changes: after the
+	// handshake, and when path mtu discovery lowers it.
+	SetMSS(mss int)
+}
+
+// CongestionByName returns the constructor for "reno" or "cubic", for
+// command line flags.
+func CongestionByName(name string) (func(mss int) CongestionControl, error) {
+	switch name {
+	case "reno":
+		return NewReno, nil
+	case "cubic":
+		return NewCubic, nil
+	}
+	return nil, fmt.Errorf("unknown congestion control %q", name)
+}
+
+const (
+	initialWindow   = 2        // segments, rfc 5681 for a 1024 byte mss would allow 4
+	initialSsthresh = 64 << 10 // the largest window without window scaling
+)
+
+// Reno is slow start plus additive increase, multiplicative decrease.
+type Reno struct {
+	mss      int
+	cwnd     int
+	ssthresh int
+}
+
+func NewReno(mss int) CongestionControl {
+	return &Reno{mss: mss, cwnd: initialWindow * mss, ssthresh: initialSsthresh}
+}
+
+func (r *Reno) Name() string  { return "reno" }
+func (r *Reno) Cwnd() int     { return r.cwnd }
+func (r *Reno) Ssthresh() int { return r.ssthresh }
+
+func (r *Reno) OnAck(acked int) {
+	if r.cwnd < r.ssthresh {
+		r.cwnd += min(acked, r.mss) // slow start, one mss per ack at most
+		return
+	}
+	r.cwnd += max(1, r.mss*r.mss/r.cwnd) // about one mss per rtt
+}
+
+// SetMSS keeps cwnd the same number of segments.
+func (r *Reno) SetMSS(mss int) {
+	r.cwnd = max(mss, r.cwnd*mss/r.mss)
+	r.mss = mss
+}
+
+func (r *Reno) OnLoss(inFlight int, timeout bool) {
+	r.ssthresh = max(inFlight/2, 2*r.mss)
+	if timeout {
+		r.cwnd = r.mss
+	} else {
+		r.cwnd = r.ssthresh
+	}
+}
+
+// Cubic grows the window as a cubic function of the time since the last
+// loss (rfc 9438), so it gets back to the old maximum fast and then
+// probes slowly around it.
+type Cubic struct {
+	mss      int
+	cwnd     int
+	ssthresh int
+
+	wMax       float64 // window before the last loss, in segments
+	k          float64 // seconds until the curve is back at wMax
+	epochStart time.Time
+	wEst       float64 // what reno would have by now, in segments
+}
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+func NewCubic(mss int) CongestionControl {
+	return &Cubic{mss: mss, cwnd: initialWindow * mss, ssthresh: initialSsthresh}
+}
+
+func (c *Cubic) Name() string  { return "cubic" }
+func (c *Cubic) Cwnd() int     { return c.cwnd }
+func (c *Cubic) Ssthresh() int { return c.ssthresh }
+
+func (c *Cubic) OnAck(acked int) {
+	if c.cwnd < c.ssthresh {
+		c.cwnd += min(acked, c.mss)
+		return
+	}
+
+	cwnd := float64(c.cwnd) / float64(c.mss)
+	now := time.Now()
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		if cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+		} else {
+			c.k = 0
+			c.wMax = cwnd
+		}
+		c.wEst = cwnd
+	}
+
+	t := now.Sub(c.epochStart).Seconds()
+	target := c.wMax + cubicC*math.Pow(t-c.k, 3)
+	target = math.Min(math.Max(target, cwnd), 1.5*cwnd)
+
+	segs := float64(acked) / float64(c.mss)
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * segs / cwnd
+	if c.wEst > target {
+		target = c.wEst // reno friendly region
+	}
+
+	c.cwnd += max(1, int((target-cwnd)/cwnd*segs*float64(c.mss)))
+}
+
+// SetMSS keeps cwnd the same number of segments, wMax already counts
+// segments.
+func (c *Cubic) SetMSS(mss int) {
+	c.cwnd = max(mss, c.cwnd*mss/c.mss)
+	c.mss = mss
+}
+
+func (c *Cubic) OnLoss(inFlight int, timeout bool) {
+	cwnd := float64(c.cwnd) / float64(c.mss)
+	if cwnd < c.wMax {
+		c.wMax = cwnd * (1 + cubicBeta) / 2 // fast convergence, leave room for others
+	} else {
+		c.wMax = cwnd
+	}
+	c.epochStart = time.Time{}
+	c.ssthresh = max(int(float64(c.cwnd)*cubicBeta), 2*c.mss)
+	if timeout {
+		c.cwnd = c.mss
+	} else {
+		c.cwnd = c.ssthresh
+	}
+}
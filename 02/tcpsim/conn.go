@@ -0,0 +1,992 @@
+package tcpsim
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"tcp-sim/computer"
+	"tcp-sim/header"
+	"tcp-sim/isn"
+)
+
+const (
+	sendBufMax = 64 * 1024        // Write blocks once this much is queued
+	maxWindow  = 65535            // largest window the 16 bit field can carry
+	maxRetries = 8                // timeouts in a row before we give up
+	finTimeout = 60 * time.Second // how long a closed conn waits for the peer's FIN
+	defaultMSL = 30 * time.Second // TIME_WAIT is twice this
+)
+
+type state int
+
+const (
+	stateClosed state = iota
+	stateSynSent
+	stateSynRcvd
+	stateEstablished
+	stateFinWait1
+	stateFinWait2
+	stateCloseWait
+	stateClosing
+	stateLastAck
+	stateTimeWait
+)
+
+var stateNames = [...]string{"CLOSED", "SYN_SENT", "SYN_RCVD", "ESTABLISHED",
+	"FIN_WAIT_1", "FIN_WAIT_2", "CLOSE_WAIT", "CLOSING", "LAST_ACK", "TIME_WAIT"}
+
+func (s state) String() string {
+	return stateNames[s]
+}
+
+// Conn is one simulated tcp connection. it implements net.Conn.
+type Conn struct {
+	comp  *computer.Computer
+	dst   *net.UDPAddr // where segments go, nil on a dialed udp conn
+	raddr *net.UDPAddr
+	opts  Options
+
+	mu      sync.Mutex
+	state   state
+	changed chan struct{} // closed and replaced on every change, wakes Read/Write/Dial
+
+	iss    uint32
+	sndUna uint32 // oldest unacked seq
+	sndNxt uint32 // next seq to send
+	sndMax uint32 // highest seq sent so far, sndNxt drops back on go-back-n
+	sndBuf []byte // bytes from sndUna on, sent or not
+	finQ   bool   // Close was called, FIN goes out after sndBuf
+
+	mss        int // payload bytes per segment, see mss.go
+	rcvMSS     int // the mss in our SYN
+	peerMSS    int // the mss in the peer's SYN
+	mssDrops   int // times path mtu discovery made mss smaller
+	blackHoles int // of those, after timeouts instead of an icmp
+
+	cc       CongestionControl
+	dupAcks  int
+	recovery bool   // in fast recovery until recover is acked
+	recover  uint32 // sndMax when fast recovery started
+	inflate  int    // window inflation during fast recovery
+
+	rtt             rttEstimator
+	timeouts        int
+	fastRetransmits int
+	arq             ARQ
+	rexmits         int // data segments sent again
+	rexmitBytes     int
+	dataBytes       int // payload sent, retransmissions included
+
+	sndWnd     uint32 // window the peer advertised
+	sndWl1     uint32 // seq and ack of the segment that set sndWnd
+	sndWl2     uint32
+	persisting bool // the timer is the persist timer, the peer's window is 0
+	persistN   int  // probes sent since the window closed, for the backoff
+	probes     int
+
+	rcvNxt     uint32
+	rcvBuf     []byte
+	rcvBufSize int
+	rcvAdvEdge uint32 // rcvNxt + window in the last segment we sent
+	rcvFin     bool   // peer sent FIN, Read returns EOF once rcvBuf is empty
+	reasm      reassembly
+	outOfOrder int // segments that came ahead of a gap
+
+	simOpen     bool // got the peer's SYN while in SYN_SENT
+	oldSegments int  // dropped in TIME_WAIT
+
+	nagle  bool // hold small segments while data is unacked, see SetNoDelay
+	delack delayedAck
+
+	segsSent int
+	dataSent int // segments with payload
+	acksSent int // pure ACKs, no data, SYN or FIN
+	segsRcvd int
+	acksRcvd int
+
+	ka         keepalive
+	lastRecv   time.Time // last segment from the peer
+	lastActive time.Time // last data or FIN either way, for the listener's idle timeout
+
+	closed  bool  // Close was called
+	err     error // set when the conn is reset or times out
+	softErr error // last icmp error, reported if the conn times out
+
+	timer    *time.Timer
+	timerGen int
+	retries  int
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	onEstablished func(*Conn) bool // listener: queue for Accept
+	onDone        func(*Conn)      // called once the conn reaches CLOSED
+}
+
+func newConn(comp *computer.Computer, dst, raddr *net.UDPAddr, opts Options) *Conn {
+	newCC := opts.Congestion
+	if newCC == nil {
+		newCC = NewReno
+	}
+	rcvBufSize := opts.RecvWindow
+	if rcvBufSize <= 0 || rcvBufSize > maxWindow {
+		rcvBufSize = maxWindow
+	}
+	mss := advertisedMSS(opts) // until the peer's SYN says otherwise
+	return &Conn{
+		comp:          comp,
+		dst:           dst,
+		raddr:         raddr,
+		opts:          opts,
+		mss:           mss,
+		rcvMSS:        mss,
+		peerMSS:       defaultPeerMSS,
+		cc:            newCC(mss),
+		rtt:           newRTTEstimator(opts.MinRTO, opts.MaxRTO, opts.OnRTT),
+		arq:           opts.ARQ,
+		rcvBufSize:    rcvBufSize,
+		nagle:         opts.Nagle,
+		delack:        delayedAck{on: opts.DelayedAck},
+		ka:            keepalive{cfg: keepAliveConfig(opts.KeepAlive)},
+		lastActive:    time.Now(),
+		changed:       make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// wake everyone waiting on the conn. must hold c.mu.
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *Conn) send(flags byte, seq uint32, payload []byte) {
+	var h header.Header
+	h[13] = flags
+	header.SetSeq(&h, seq)
+	if flags&header.ACK != 0 {
+		header.SetAckNum(&h, c.rcvNxt)
+	}
+	wnd := c.rcvWindow()
+	header.SetWindow(&h, uint16(wnd))
+	c.rcvAdvEdge = c.rcvNxt + uint32(wnd)
+	if len(payload) > 0 || flags&header.FIN != 0 {
+		c.lastActive = time.Now()
+	}
+	c.segsSent++
+	switch {
+	case len(payload) > 0:
+		c.dataSent++
+	case flags == header.ACK:
+		c.acksSent++
+	}
+	if flags&header.ACK != 0 {
+		c.acked()
+	}
+	if flags&header.SYN != 0 {
+		opt := header.MSSOption(uint16(c.rcvMSS))
+		header.SetDataOffset(&h, len(h)+len(opt))
+		payload = append(opt, payload...)
+	}
+	header.SetPorts(&h, c.comp.LocalAddr().Port, c.raddr.Port)
+	c.comp.SendSegment(h, payload, c.dst) // a failed send is just a lost segment
+}
+
+// rcvWindow is the free space in the receive buffer. must hold c.mu.
+func (c *Conn) rcvWindow() int {
+	return c.rcvBufSize - len(c.rcvBuf)
+}
+
+func (c *Conn) armTimer(d time.Duration) {
+	c.stopTimer()
+	gen := c.timerGen
+	c.timer = time.AfterFunc(d, func() { c.onTimer(gen) })
+}
+
+func (c *Conn) stopTimer() {
+	c.persisting = false
+	c.timerGen++
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func (c *Conn) onTimer(gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.timerGen || c.state == stateClosed {
+		return // stopped or re-armed while we waited for the lock
+	}
+	c.timer = nil
+
+	if c.state == stateFinWait2 || c.state == stateTimeWait {
+		c.finish(nil)
+		return
+	}
+	if c.persisting {
+		c.probe()
+		return
+	}
+
+	c.retries++
+	if c.retries > maxRetries {
+		c.timedOut()
+		return
+	}
+	c.timeouts++
+	c.rtt.retransmitted()
+	c.rtt.backoff()
+
+	switch c.state {
+	case stateSynSent:
+		c.send(header.SYN, c.iss, nil)
+		c.armTimer(c.rtt.rto)
+	case stateSynRcvd:
+		c.send(header.SYN|header.ACK, c.iss, nil)
+		c.armTimer(c.rtt.rto)
+	default:
+		c.blackHole()
+		c.cc.OnLoss(int(c.sndMax-c.sndUna), true)
+		c.trace("timeout")
+		c.dupAcks = 0
+		if c.arq == SelectiveRepeat {
+			c.selectiveTimeout()
+			return
+		}
+		c.recovery = false
+		c.recover = c.sndMax // no fast retransmit for what was sent before the timeout
+		c.inflate = 0
+		c.sndNxt = c.sndUna // go-back-n: resend everything unacked
+		c.output()
+	}
+}
+
+func (c *Conn) newISS() uint32 {
+	if c.opts.ISN != nil {
+		return c.opts.ISN(c.comp.LocalAddrFor(c.raddr), c.raddr)
+	}
+	return isn.Generate(c.comp.LocalAddrFor(c.raddr), c.raddr)
+}
+
+// activeOpen sends the SYN and blocks until the handshake is done.
+func (c *Conn) activeOpen() error {
+	c.mu.Lock()
+	c.iss = c.newISS()
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.state = stateSynSent
+	c.send(header.SYN, c.iss, nil)
+	c.rtt.start(c.sndNxt)
+	c.armTimer(c.rtt.rto)
+
+	for c.state == stateSynSent || c.state == stateSynRcvd {
+		wait := c.changed
+		c.mu.Unlock()
+		<-wait
+		c.mu.Lock()
+	}
+	err := c.err
+	c.mu.Unlock()
+	return err
+}
+
+// passiveOpen answers a SYN that a listener received.
+func (c *Conn) passiveOpen(syn header.Header, opts []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peerOptions(opts)
+	c.rcvNxt = header.GetSeq(&syn) + 1
+	c.sndWnd = uint32(header.GetWindow(&syn))
+	c.sndWl1 = header.GetSeq(&syn)
+	c.iss = c.newISS()
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.state = stateSynRcvd
+	c.send(header.SYN|header.ACK, c.iss, nil)
+	c.rtt.start(c.sndNxt)
+	c.armTimer(c.rtt.rto)
+}
+
+// cookieOpen rebuilds the SYN_RCVD state a syn cookie stands for, so the
+// ACK carrying it can be fed to input like for any other handshake. mss
+// is the peer's, as far as the cookie could keep it.
+func (c *Conn) cookieOpen(irs, iss uint32, mss int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peerMSS = mss
+	c.setMSS(min(mss, c.rcvMSS))
+	c.rcvNxt = irs + 1
+	c.iss = iss
+	c.sndUna = iss
+	c.sndNxt = iss + 1
+	c.sndMax = c.sndNxt
+	c.state = stateSynRcvd
+}
+
+// simultaneousOpen handles a SYN that crossed ours: both sides sent SYN,
+// so we go to SYN_RCVD and send a SYN-ACK for it (rfc 9293 3.5). the
+// peer's SYN-ACK then finishes the handshake. must hold c.mu.
+func (c *Conn) simultaneousOpen(syn header.Header, opts []byte) {
+	c.simOpen = true
+	c.peerOptions(opts)
+	c.rcvNxt = header.GetSeq(&syn) + 1
+	c.sndWnd = uint32(header.GetWindow(&syn))
+	c.sndWl1 = header.GetSeq(&syn)
+	c.state = stateSynRcvd
+	c.send(header.SYN|header.ACK, c.iss, nil)
+	c.rtt.retransmitted() // the SYN in flight was sent before, no clean sample
+	c.armTimer(c.rtt.rto)
+	c.notify()
+}
+
+// refused ends a handshake that the udp layer reports as unreachable.
+func (c *Conn) refused() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateSynSent {
+		c.finish(syscall.ECONNREFUSED)
+	}
+}
+
+// unreachable handles an icmp error about our segments. during the
+// handshake it ends the dial at once, like a refused one. later it is a
+// soft error (rfc 1122 4.2.3.9): routes come back, so it is only
+// reported if the conn times out. with Options.PMTUD, fragmentation
+// needed makes the segments smaller instead.
+func (c *Conn) unreachable(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != stateClosed && c.tooBig(err) {
+		return
+	}
+	switch c.state {
+	case stateClosed:
+	case stateSynSent:
+		c.finish(err)
+	default:
+		c.softErr = err
+	}
+}
+
+// timedOut gives up on a peer that stopped answering. must hold c.mu.
+func (c *Conn) timedOut() {
+	if c.softErr != nil {
+		c.finish(c.softErr)
+		return
+	}
+	c.finish(syscall.ETIMEDOUT)
+}
+
+// input handles one segment from the peer, its options split off.
+func (c *Conn) input(h header.Header, opts, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := header.GetSeq(&h)
+	ack := header.GetAckNum(&h)
+	if c.state != stateClosed {
+		c.heard(len(payload) > 0 || header.IsFin(&h))
+		c.segsRcvd++
+		if len(payload) == 0 && h[13] == header.ACK {
+			c.acksRcvd++
+		}
+	}
+
+	if header.IsRst(&h) {
+		switch c.state {
+		case stateClosed, stateTimeWait: // no time-wait assassination (rfc 1337)
+		case stateSynSent:
+			if header.IsAck(&h) && ack == c.iss+1 {
+				c.finish(syscall.ECONNREFUSED)
+			}
+		default:
+			c.finish(syscall.ECONNRESET)
+		}
+		return
+	}
+
+	switch c.state {
+	case stateClosed:
+		return
+
+	case stateTimeWait:
+		c.timeWait(h, seq, payload)
+		return
+
+	case stateSynSent:
+		if header.IsSyn(&h) && !header.IsAck(&h) {
+			c.simultaneousOpen(h, opts)
+			return
+		}
+		if !header.IsSynAck(&h) || ack != c.iss+1 {
+			return
+		}
+		c.peerOptions(opts)
+		c.rcvNxt = seq + 1
+		c.sndUna = ack
+		c.sndWnd = uint32(header.GetWindow(&h))
+		c.sndWl1 = seq
+		c.sndWl2 = ack
+		c.rtt.ack(ack)
+		c.retries = 0
+		c.stopTimer()
+		c.state = stateEstablished
+		c.armKeepAlive(c.ka.cfg.Idle)
+		c.send(header.ACK, c.sndNxt, nil)
+		c.notify()
+		return
+
+	case stateSynRcvd:
+		if header.IsSyn(&h) && !header.IsAck(&h) {
+			c.send(header.SYN|header.ACK, c.iss, nil) // our SYN-ACK got lost
+			c.rtt.retransmitted()
+			return
+		}
+		if !header.IsAck(&h) || ack != c.iss+1 {
+			return
+		}
+		if header.IsSyn(&h) {
+			// simultaneous open, the peer's SYN-ACK acks our SYN
+			c.send(header.ACK, c.sndNxt, nil)
+		}
+		c.sndUna = ack
+		c.sndWnd = uint32(header.GetWindow(&h))
+		c.sndWl1 = seq
+		c.sndWl2 = ack
+		c.rtt.ack(ack)
+		c.retries = 0
+		c.stopTimer()
+		c.state = stateEstablished
+		c.armKeepAlive(c.ka.cfg.Idle)
+		if c.onEstablished != nil && !c.onEstablished(c) {
+			c.send(header.RST, c.sndNxt, nil) // accept queue is full
+			c.finish(syscall.ECONNRESET)
+			return
+		}
+		c.notify()
+		if header.IsSyn(&h) {
+			return
+		}
+	}
+
+	if header.IsSyn(&h) {
+		c.send(header.ACK, c.sndNxt, nil) // peer lost our ACK of its SYN-ACK
+		return
+	}
+	if header.IsAck(&h) {
+		pure := len(payload) == 0 && !header.IsFin(&h)
+		c.processAck(seq, ack, uint32(header.GetWindow(&h)), pure)
+	}
+	if c.state != stateClosed {
+		c.processData(seq, payload, header.IsFin(&h))
+	}
+	if c.state != stateClosed {
+		c.output()
+	}
+}
+
+func (c *Conn) processAck(seq, ack, wnd uint32, pure bool) {
+	if seqLT(ack, c.sndUna) || seqGT(ack, c.sndMax) {
+		return // old or bogus
+	}
+	changed := c.updateWindow(seq, ack, wnd)
+	if ack == c.sndUna {
+		// a pure ack for nothing new, with the same window, is a dup
+		// ack: the receiver saw a gap
+		if pure && !changed && c.sndMax != c.sndUna {
+			c.dupAck()
+		}
+		return
+	}
+
+	finAcked := false
+	n := int(ack - c.sndUna)
+	if n > len(c.sndBuf) {
+		finAcked = true // FIN takes one seq after the data
+		c.sndBuf = nil
+	} else {
+		c.sndBuf = c.sndBuf[n:]
+	}
+	c.sndUna = ack
+	if seqLT(c.sndNxt, ack) {
+		c.sndNxt = ack
+	}
+	c.rtt.ack(ack)
+	c.newAck(n)
+	c.retries = 0
+	if c.sndUna == c.sndMax {
+		c.stopTimer()
+	} else {
+		c.armTimer(c.rtt.rto)
+	}
+
+	if finAcked {
+		switch c.state {
+		case stateFinWait1:
+			c.state = stateFinWait2
+			c.armTimer(finTimeout)
+		case stateClosing:
+			c.enterTimeWait()
+			return
+		case stateLastAck:
+			c.finish(nil)
+			return
+		}
+	}
+	c.notify()
+}
+
+func (c *Conn) processData(seq uint32, payload []byte, fin bool) {
+	if len(payload) == 0 && !fin {
+		if seq == c.rcvNxt-1 {
+			c.send(header.ACK, c.sndNxt, nil) // zero window probe, tell our window
+		}
+		return
+	}
+
+	if seqLT(seq, c.rcvNxt) {
+		skip := c.rcvNxt - seq
+		if int(skip) > len(payload) || (int(skip) == len(payload) && !fin) {
+			c.send(header.ACK, c.sndNxt, nil) // duplicate, ack again
+			return
+		}
+		payload = payload[skip:]
+		seq = c.rcvNxt
+	}
+	if c.rcvFin {
+		c.send(header.ACK, c.sndNxt, nil)
+		return
+	}
+	if wnd, off := c.rcvWindow(), int(seq-c.rcvNxt); off+len(payload) > wnd {
+		payload = payload[:max(0, wnd-off)] // the rest did not fit the window we gave
+		fin = false
+		if len(payload) == 0 {
+			c.send(header.ACK, c.sndNxt, nil)
+			return
+		}
+	}
+	if seq != c.rcvNxt {
+		// ahead of a gap: keep it, and the dup ack tells the sender
+		// where the gap is. go-back-n throws it away
+		if c.arq != GoBackN {
+			c.reasm.insert(c.rcvNxt, seq, payload, fin)
+		}
+		c.outOfOrder++
+		c.send(header.ACK, c.sndNxt, nil)
+		return
+	}
+
+	gap := c.reasm.bytes() > 0
+	c.deliver(payload)
+	for !fin {
+		more, queuedFin := c.reasm.next(c.rcvNxt)
+		if len(more) == 0 && !queuedFin {
+			break
+		}
+		c.deliver(more)
+		fin = queuedFin
+	}
+
+	if fin {
+		c.rcvNxt++
+		c.rcvFin = true
+		c.reasm = reassembly{}
+		switch c.state {
+		case stateEstablished:
+			c.state = stateCloseWait
+		case stateFinWait1:
+			c.state = stateClosing
+		case stateFinWait2:
+			c.send(header.ACK, c.sndNxt, nil)
+			c.enterTimeWait()
+			return
+		}
+	}
+	if fin || gap {
+		// a FIN, or data that fills (part of) a gap, is acked at once
+		c.send(header.ACK, c.sndNxt, nil)
+	} else {
+		c.ackData(len(payload))
+	}
+	c.notify()
+}
+
+// updateWindow takes the peer's window from a segment unless an older
+// segment arrived late (rfc 9293 3.10.7.4). it reports if the window
+// changed. must hold c.mu.
+func (c *Conn) updateWindow(seq, ack, wnd uint32) bool {
+	if !seqLT(c.sndWl1, seq) && !(c.sndWl1 == seq && seqLEQ(c.sndWl2, ack)) {
+		return false
+	}
+	changed := c.sndWnd != wnd
+	c.sndWnd = wnd
+	c.sndWl1 = seq
+	c.sndWl2 = ack
+	if wnd > 0 && c.persisting {
+		c.stopTimer() // window is open again, output takes over
+		c.persistN = 0
+	}
+	return changed
+}
+
+// dupAck counts duplicate acks, the third one starts fast retransmit
+// and fast recovery. must hold c.mu.
+func (c *Conn) dupAck() {
+	c.dupAcks++
+	switch {
+	case c.recovery:
+		c.inflate += c.mss // one more segment has left the network
+		c.output()
+	case c.dupAcks == 3 && seqGT(c.sndUna, c.recover):
+		c.cc.OnLoss(int(c.sndMax-c.sndUna), false)
+		c.recovery = true
+		c.recover = c.sndMax
+		c.inflate = 3 * c.mss
+		c.fastRetransmits++
+		c.trace("fast_retransmit")
+		c.retransmit() // the receiver keeps what came after the hole
+		c.output()
+	}
+}
+
+// newAck updates the congestion state for n newly acked bytes. must
+// hold c.mu.
+func (c *Conn) newAck(n int) {
+	c.dupAcks = 0
+	if !c.recovery {
+		c.cc.OnAck(n)
+		c.trace("ack")
+		return
+	}
+	if seqGEQ(c.sndUna, c.recover) {
+		c.recovery = false // everything sent before the loss is acked
+		c.inflate = 0
+		c.trace("recovered")
+		return
+	}
+	// partial ack: the next segment after the one we resent is lost
+	// too. resend it and deflate by what left the network (rfc 6582)
+	c.retransmit()
+	c.inflate = max(0, c.inflate-n+c.mss)
+}
+
+// retransmit resends the first unacked segment. must hold c.mu.
+func (c *Conn) retransmit() {
+	c.rtt.retransmitted()
+	c.sendAt(c.sndUna, c.mss)
+}
+
+// sendAt sends the segment that starts at seq, with at most limit bytes
+// of data, and returns how much sequence space it took. must hold c.mu.
+func (c *Conn) sendAt(seq uint32, limit int) uint32 {
+	off := int(seq - c.sndUna)
+	if off < len(c.sndBuf) {
+		n := min(c.mss, limit, len(c.sndBuf)-off)
+		c.dataBytes += n
+		if seqLT(seq, c.sndMax) {
+			c.rexmits++
+			c.rexmitBytes += n
+		}
+		c.send(header.ACK, seq, c.sndBuf[off:off+n])
+		return uint32(n)
+	}
+	if c.finQ && off == len(c.sndBuf) {
+		c.send(header.FIN|header.ACK, seq, nil)
+		return 1
+	}
+	return 0
+}
+
+// window is how far past sndUna we may send: the smaller of the
+// congestion window and the peer's receive window.
+func (c *Conn) window() uint32 {
+	return min(uint32(c.cc.Cwnd()+c.inflate), c.sndWnd)
+}
+
+// probe sends a zero window probe. it is an ACK with an old seq, which
+// the peer answers with its current window. must hold c.mu.
+func (c *Conn) probe() {
+	c.probes++
+	c.persistN++
+	c.send(header.ACK, c.sndUna-1, nil)
+	c.armPersist()
+}
+
+func (c *Conn) armPersist() {
+	c.armTimer(c.rtt.clamp(c.rtt.rto << min(c.persistN, 10)))
+	c.persisting = true
+}
+
+func (c *Conn) trace(event string) {
+	c.opts.Trace.log(c.raddr, event, c.cc.Cwnd(), c.cc.Ssthresh(), int(c.sndMax-c.sndUna))
+}
+
+// output sends whatever the window allows. must hold c.mu.
+func (c *Conn) output() {
+	switch c.state {
+	case stateEstablished, stateCloseWait, stateFinWait1, stateClosing, stateLastAck:
+	default:
+		return
+	}
+
+	for {
+		inFlight := c.sndNxt - c.sndUna
+		if int(inFlight) < len(c.sndBuf) && inFlight >= c.window() {
+			break
+		}
+		if c.nagleHolds(c.sndNxt, int(c.window()-inFlight)) {
+			break // the ACK for what is out sends it
+		}
+		n := c.sendAt(c.sndNxt, int(c.window()-inFlight))
+		if n == 0 {
+			break
+		}
+		if c.sndNxt == c.sndMax {
+			c.rtt.start(c.sndNxt + n) // new data
+		} else {
+			c.rtt.retransmitted()
+		}
+		c.sndNxt += n
+
+		if seqGT(c.sndNxt, c.sndMax) {
+			c.sndMax = c.sndNxt
+		}
+		if c.timer == nil {
+			c.armTimer(c.rtt.rto)
+		}
+	}
+
+	if c.sndWnd == 0 && c.sndNxt == c.sndUna && len(c.sndBuf) > 0 && c.timer == nil {
+		c.armPersist() // the peer has no room, ask again now and then
+	}
+}
+
+// deliver hands in-order data to Read. must hold c.mu.
+func (c *Conn) deliver(data []byte) {
+	if !c.closed {
+		c.rcvBuf = append(c.rcvBuf, data...)
+	}
+	c.rcvNxt += uint32(len(data))
+}
+
+// enterTimeWait waits 2*MSL before the conn is really gone, so a lost
+// last ACK can be sent again and old segments of this connection can't
+// end up in a new one on the same ports. must hold c.mu.
+func (c *Conn) enterTimeWait() {
+	c.state = stateTimeWait
+	c.armTimer(2 * c.msl())
+	c.notify()
+}
+
+func (c *Conn) msl() time.Duration {
+	if c.opts.MSL > 0 {
+		return c.opts.MSL
+	}
+	return defaultMSL
+}
+
+// timeWait handles a segment in TIME_WAIT. must hold c.mu.
+func (c *Conn) timeWait(h header.Header, seq uint32, payload []byte) {
+	switch {
+	case header.IsFin(&h) && seq+uint32(len(payload))+1 == c.rcvNxt:
+		// the peer resent its FIN, so our ACK got lost
+		c.send(header.ACK, c.sndNxt, nil)
+		c.armTimer(2 * c.msl())
+	case header.IsSyn(&h) && !header.IsAck(&h) && seqGT(seq, c.rcvNxt):
+		// a new connection on the same ports (rfc 6191). make room, the
+		// peer sends its SYN again and gets a fresh conn
+		c.finish(nil)
+	default:
+		c.oldSegments++ // an old duplicate, it must not reach anyone
+	}
+}
+
+// finish moves the conn to CLOSED. must hold c.mu.
+func (c *Conn) finish(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	c.stopTimer()
+	c.armKeepAlive(0) // stops it, a closed conn is not probed
+	c.acked()         // and no delayed ACK either
+	if c.err == nil {
+		c.err = err
+	}
+	c.notify()
+	if c.onDone != nil {
+		c.onDone(c)
+	}
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: network, Source: c.LocalAddr(), Addr: c.raddr, Err: err}
+}
+
+// Read reads data in order. it returns io.EOF after the peer's FIN.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		switch {
+		case c.closed:
+			c.mu.Unlock()
+			return 0, c.opError("read", net.ErrClosed)
+		case c.readDeadline.expired():
+			c.mu.Unlock()
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		case len(c.rcvBuf) > 0:
+			n := copy(b, c.rcvBuf)
+			c.rcvBuf = c.rcvBuf[n:]
+			c.windowUpdate()
+			c.mu.Unlock()
+			return n, nil
+		case c.rcvFin:
+			c.mu.Unlock()
+			return 0, io.EOF
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return 0, c.opError("read", err)
+		case len(b) == 0:
+			c.mu.Unlock()
+			return 0, nil
+		}
+		wait := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-c.readDeadline.wait():
+		}
+	}
+}
+
+// windowUpdate tells the peer about space a Read freed, but only once it
+// is worth a segment, so we don't advertise silly small windows (rfc 9293
+// 3.8.6.2.2). must hold c.mu.
+func (c *Conn) windowUpdate() {
+	switch c.state {
+	case stateEstablished, stateFinWait1, stateFinWait2:
+	default:
+		return
+	}
+	edge := c.rcvNxt + uint32(c.rcvWindow())
+	if int32(edge-c.rcvAdvEdge) >= int32(min(c.mss, c.rcvBufSize/2)) {
+		c.send(header.ACK, c.sndNxt, nil)
+	}
+}
+
+// Write queues b for sending and blocks while the send buffer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	total := 0
+	for {
+		c.mu.Lock()
+		switch {
+		case c.closed:
+			c.mu.Unlock()
+			return total, c.opError("write", net.ErrClosed)
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return total, c.opError("write", err)
+		case c.state != stateEstablished && c.state != stateCloseWait:
+			c.mu.Unlock()
+			return total, c.opError("write", syscall.EPIPE)
+		}
+		if c.writeDeadline.expired() {
+			c.mu.Unlock()
+			return total, c.opError("write", os.ErrDeadlineExceeded)
+		}
+		if room := sendBufMax - len(c.sndBuf); room > 0 {
+			n := min(room, len(b))
+			c.sndBuf = append(c.sndBuf, b[:n]...)
+			b = b[n:]
+			total += n
+			c.output()
+			if len(b) == 0 {
+				c.mu.Unlock()
+				return total, nil
+			}
+		}
+		wait := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-c.writeDeadline.wait():
+		}
+	}
+}
+
+// Close sends a FIN after the queued data and returns right away, like a
+// normal socket close. the FIN exchange finishes in the background.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return c.opError("close", net.ErrClosed)
+	}
+	c.closed = true
+	c.rcvBuf = nil
+
+	switch c.state {
+	case stateEstablished:
+		c.state = stateFinWait1
+		c.finQ = true
+		c.output()
+	case stateCloseWait:
+		c.state = stateLastAck
+		c.finQ = true
+		c.output()
+	case stateSynSent, stateSynRcvd:
+		c.finish(nil)
+	}
+	c.notify()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.comp.LocalAddrFor(c.raddr)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadBuffer sets the size of the receive buffer, like
+// net.TCPConn.SetReadBuffer. it is the largest window we advertise,
+// 65535 at most.
+func (c *Conn) SetReadBuffer(bytes int) error {
+	if bytes <= 0 {
+		return c.opError("set", syscall.EINVAL)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rcvBufSize = max(min(bytes, maxWindow), len(c.rcvBuf))
+	c.windowUpdate() // if it grew enough to tell the peer
+	return nil
+}
@@ -0,0 +1,90 @@
+package tcpsim
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// CookieMode says when a Listener answers a SYN with a syn cookie
+// instead of an entry in its SYN_RCVD table.
+type CookieMode int
+
+const (
+	CookiesWhenFull CookieMode = iota // only once the SYN_RCVD table is full
+	CookiesOff                        // a full table drops the SYN
+	CookiesAlways                     // never keep half-open state
+)
+
+// a cookie is the ISN of our SYN-ACK, laid out like bernstein's:
+//
+//	bits 31-27  t mod 32, t counts 64 second periods
+//	bits 26-24  index in cookieMSS of the client's mss, rounded down
+//	bits 23-0   keyed hash of t, the mss index, the 4-tuple and the
+//	            client's ISN
+//
+// the ACK that finishes the handshake carries cookie+1, so we can check
+// it and build the connection without having stored anything.
+const cookiePeriod = 64 * time.Second
+
+// the mss values a cookie can stand for. a client below the first still
+// gets it, like linux does with its 536.
+var cookieMSS = [8]int{64, 256, 536, 1024, 1220, 1300, 1440, 1460}
+
+func cookieMSSIndex(mss int) uint32 {
+	i := len(cookieMSS) - 1
+	for i > 0 && cookieMSS[i] > mss {
+		i--
+	}
+	return uint32(i)
+}
+
+type cookieJar struct {
+	secret [32]byte
+}
+
+func newCookieJar() *cookieJar {
+	var j cookieJar
+	rand.Read(j.secret[:])
+	return &j
+}
+
+func cookieTime(now time.Time) uint32 {
+	return uint32(now.Unix() / int64(cookiePeriod/time.Second))
+}
+
+func (j *cookieJar) hash(t, mssIdx uint32, raddr *net.UDPAddr, lport uint16, irs uint32) uint32 {
+	mac := hmac.New(sha256.New, j.secret[:])
+	mac.Write(raddr.IP.To16())
+	var b [13]byte
+	binary.BigEndian.PutUint16(b[0:], uint16(raddr.Port))
+	binary.BigEndian.PutUint16(b[2:], lport)
+	binary.BigEndian.PutUint32(b[4:], irs)
+	binary.BigEndian.PutUint32(b[8:], t)
+	b[12] = byte(mssIdx)
+	mac.Write(b[:])
+	sum := mac.Sum(nil)
+	return uint32(sum[0])<<16 | uint32(sum[1])<<8 | uint32(sum[2])
+}
+
+func (j *cookieJar) make(raddr *net.UDPAddr, lport uint16, irs uint32, mss int, now time.Time) uint32 {
+	t := cookieTime(now)
+	m := cookieMSSIndex(mss)
+	return (t%32)<<27 | m<<24 | j.hash(t, m, raddr, lport, irs)
+}
+
+// check accepts cookies from this period and the one before, and
+// returns the mss the cookie kept.
+func (j *cookieJar) check(cookie uint32, raddr *net.UDPAddr, lport uint16, irs uint32, now time.Time) (int, bool) {
+	t := cookieTime(now)
+	m := cookie >> 24 & 7
+	for _, tt := range []uint32{t, t - 1} {
+		if cookie == (tt%32)<<27|m<<24|j.hash(tt, m, raddr, lport, irs) {
+			return cookieMSS[m], true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,151 @@
+package tcpsim
+
+import (
+	"net"
+	"time"
+
+	"tcp-sim/header"
+)
+
+// same defaults as the net package
+const (
+	defaultKeepAliveIdle     = 15 * time.Second
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultKeepAliveCount    = 9
+)
+
+// keepalive probes a conn that went quiet. after Idle without a segment
+// from the peer we send an ACK with an old seq, which the peer has to
+// answer (rfc 9293 3.8.4). Count probes in a row without an answer and
+// the peer is taken as dead.
+type keepalive struct {
+	cfg    net.KeepAliveConfig
+	timer  *time.Timer
+	gen    int
+	probes int // unanswered probes
+	sent   int // all probes, for Stats
+}
+
+// keepAliveConfig fills in the defaults like net.KeepAliveConfig does:
+// 0 is the default and -1 turns a setting off.
+func keepAliveConfig(cfg net.KeepAliveConfig) net.KeepAliveConfig {
+	if cfg.Idle == 0 {
+		cfg.Idle = defaultKeepAliveIdle
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultKeepAliveInterval
+	}
+	if cfg.Count == 0 {
+		cfg.Count = defaultKeepAliveCount
+	}
+	if cfg.Idle < 0 || cfg.Interval < 0 || cfg.Count < 0 {
+		cfg.Enable = false
+	}
+	return cfg
+}
+
+// SetKeepAlive turns keepalive probes on or off, like
+// net.TCPConn.SetKeepAlive.
+func (c *Conn) SetKeepAlive(on bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ka.cfg.Enable = on
+	c.ka.cfg = keepAliveConfig(c.ka.cfg)
+	c.armKeepAlive(c.ka.cfg.Idle)
+	return nil
+}
+
+// SetKeepAliveConfig replaces the keepalive settings.
+func (c *Conn) SetKeepAliveConfig(cfg net.KeepAliveConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ka.cfg = keepAliveConfig(cfg)
+	c.armKeepAlive(c.ka.cfg.Idle)
+	return nil
+}
+
+// armKeepAlive (re)starts the keepalive timer, or stops it when keepalive
+// is off or the conn can't be probed. must hold c.mu.
+func (c *Conn) armKeepAlive(d time.Duration) {
+	c.ka.gen++
+	if c.ka.timer != nil {
+		c.ka.timer.Stop()
+		c.ka.timer = nil
+	}
+	if !c.ka.cfg.Enable {
+		return
+	}
+	switch c.state {
+	case stateEstablished, stateCloseWait:
+	default:
+		return
+	}
+	gen := c.ka.gen
+	c.ka.timer = time.AfterFunc(d, func() { c.onKeepAlive(gen) })
+}
+
+func (c *Conn) onKeepAlive(gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.ka.gen {
+		return
+	}
+	c.ka.timer = nil
+
+	if c.sndMax != c.sndUna || c.persisting {
+		// data or a window probe is out, its timer finds a dead peer
+		c.armKeepAlive(c.ka.cfg.Idle)
+		return
+	}
+	if c.ka.probes == 0 {
+		if idle := time.Since(c.lastRecv); idle < c.ka.cfg.Idle {
+			c.armKeepAlive(c.ka.cfg.Idle - idle)
+			return
+		}
+	}
+	if c.ka.probes >= c.ka.cfg.Count {
+		c.timedOut()
+		return
+	}
+	c.ka.probes++
+	c.ka.sent++
+	c.send(header.ACK, c.sndNxt-1, nil)
+	c.armKeepAlive(c.ka.cfg.Interval)
+}
+
+// heard notes a segment from the peer, it answers any probe. must hold
+// c.mu.
+func (c *Conn) heard(data bool) {
+	c.lastRecv = time.Now()
+	if data {
+		c.lastActive = c.lastRecv
+	}
+	if c.ka.probes > 0 {
+		c.ka.probes = 0
+		c.armKeepAlive(c.ka.cfg.Idle)
+	}
+}
+
+// idle is how long no data went either way.
+func (c *Conn) idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastActive)
+}
+
+// abort drops the conn with a RST, the peer gets ECONNRESET and our side
+// gets err. a conn in TIME_WAIT is left to its timer. it reports if the
+// conn was dropped.
+func (c *Conn) abort(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case stateClosed, stateTimeWait:
+		return false
+	case stateSynSent:
+	default:
+		c.send(header.RST|header.ACK, c.sndNxt, nil)
+	}
+	c.finish(err)
+	return true
+}
@@ -0,0 +1,315 @@
+package tcpsim
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"tcp-sim/computer"
+	"tcp-sim/header"
+	"tcp-sim/ip"
+)
+
+const (
+	acceptBacklog     = 16
+	defaultSynBacklog = 128
+)
+
+// ListenConfig holds the listener options. the zero value is what
+// Listen uses.
+type ListenConfig struct {
+	Options               // for every accepted conn
+	SynBacklog int        // max half-open conns, 0 means 128
+	Cookies    CookieMode // when to answer a SYN with a syn cookie
+	// IdleTimeout resets conns that sent and received no data for this
+	// long and drops them from the table, 0 keeps them forever. the
+	// accepted conn's Read and Write then fail with ECONNABORTED.
+	IdleTimeout time.Duration
+}
+
+// ListenerStats counts what a Listener did with incoming handshakes.
+type ListenerStats struct {
+	HalfOpen     int // conns in SYN_RCVD right now
+	SynDropped   int // SYNs dropped because the table was full
+	CookiesSent  int
+	CookiesOK    int // handshakes completed from a cookie
+	CookiesBad   int // ACKs with a wrong or expired cookie
+	Established  int
+	AcceptDenied int // established but the accept queue was full
+	Reaped       int // reset after IdleTimeout
+}
+
+// Listener accepts simulated tcp connections on one udp socket. all its
+// connections share that socket. they are told apart by the peer's ip and
+// the src port in the header, which is where replies go too, so a SYN
+// with a spoofed port gets its SYN-ACK sent somewhere else.
+type Listener struct {
+	comp    *computer.Computer
+	cfg     ListenConfig
+	cookies *cookieJar
+
+	mu      sync.Mutex
+	conns   map[string]*Conn
+	synRcvd map[string]bool // keys of conns still in SYN_RCVD
+	stats   ListenerStats
+	closed  bool
+
+	accept chan *Conn
+	done   chan struct{}
+}
+
+func newListener(comp *computer.Computer, cfg ListenConfig) *Listener {
+	if cfg.SynBacklog <= 0 {
+		cfg.SynBacklog = defaultSynBacklog
+	}
+	return &Listener{
+		comp:    comp,
+		cfg:     cfg,
+		cookies: newCookieJar(),
+		conns:   make(map[string]*Conn),
+		synRcvd: make(map[string]bool),
+		accept:  make(chan *Conn, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+}
+
+func (l *Listener) readLoop() {
+	for {
+		h, rest, addr, err := l.comp.ReadSegment(context.Background())
+		if err != nil {
+			if isClosedErr(err) {
+				return
+			}
+			var icmp *ip.ICMPError
+			if errors.As(err, &icmp) {
+				l.unreachable(icmp)
+			}
+			continue
+		}
+
+		opts, payload := header.SplitOptions(&h, rest)
+		raddr := &net.UDPAddr{IP: addr.IP, Port: int(header.GetSrcPort(&h)), Zone: addr.Zone}
+		if c := l.demux(h, opts, payload, raddr); c != nil {
+			c.input(h, opts, payload)
+		}
+	}
+}
+
+// unreachable passes an icmp error on to the conn it is about.
+func (l *Listener) unreachable(e *ip.ICMPError) {
+	key := (&net.UDPAddr{IP: e.Dst, Port: int(e.DstPort)}).String()
+	l.mu.Lock()
+	c := l.conns[key]
+	l.mu.Unlock()
+	if c != nil {
+		c.unreachable(e)
+	}
+}
+
+// demux finds the conn a segment is for. it answers SYNs and stray
+// segments itself and returns nil for those.
+func (l *Listener) demux(h header.Header, opts, payload []byte, raddr *net.UDPAddr) *Conn {
+	key := raddr.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c := l.conns[key]; c != nil {
+		return c
+	}
+	switch {
+	case header.IsRst(&h):
+		return nil
+	case l.closed:
+	case header.IsSyn(&h) && !header.IsAck(&h):
+		l.handleSyn(h, opts, raddr, key)
+		return nil
+	case header.IsAck(&h) && !header.IsSyn(&h) && l.cfg.Cookies != CookiesOff:
+		irs := header.GetSeq(&h) - 1
+		iss := header.GetAckNum(&h) - 1
+		if mss, ok := l.cookies.check(iss, raddr, l.port(), irs, time.Now()); ok {
+			l.stats.CookiesOK++
+			c := l.newConn(raddr, key)
+			c.cookieOpen(irs, iss, mss)
+			return c
+		}
+		l.stats.CookiesBad++
+	}
+	l.reset(h, payload, raddr)
+	return nil
+}
+
+// handleSyn starts a handshake, from the table or from a cookie. must
+// hold l.mu.
+func (l *Listener) handleSyn(syn header.Header, opts []byte, raddr *net.UDPAddr, key string) {
+	full := len(l.synRcvd) >= l.cfg.SynBacklog
+	switch {
+	case l.cfg.Cookies == CookiesAlways || (full && l.cfg.Cookies == CookiesWhenFull):
+		irs := header.GetSeq(&syn)
+		mss, ok := header.GetMSS(opts)
+		if !ok {
+			mss = defaultPeerMSS
+		}
+		var h header.Header
+		header.SetSynAck(&h)
+		header.SetSeq(&h, l.cookies.make(raddr, l.port(), irs, int(mss), time.Now()))
+		header.SetAckNum(&h, irs+1)
+		header.SetPorts(&h, int(l.port()), raddr.Port)
+		opt := header.MSSOption(uint16(advertisedMSS(l.cfg.Options)))
+		header.SetDataOffset(&h, len(h)+len(opt))
+		l.comp.SendSegment(h, opt, raddr)
+		l.stats.CookiesSent++
+	case full:
+		l.stats.SynDropped++
+	default:
+		c := l.newConn(raddr, key)
+		l.synRcvd[key] = true
+		c.passiveOpen(syn, opts)
+	}
+}
+
+// must hold l.mu. nobody else can reach the new conn before it is in
+// l.conns, so locking it from here cannot deadlock with its callbacks.
+func (l *Listener) newConn(raddr *net.UDPAddr, key string) *Conn {
+	c := newConn(l.comp, raddr, raddr, l.cfg.Options)
+	c.onEstablished = func(c *Conn) bool { return l.queue(key, c) }
+	c.onDone = func(*Conn) { l.remove(key) }
+	l.conns[key] = c
+	return c
+}
+
+// reapLoop resets the conns that were idle for too long, every quarter
+// of the timeout, until the listener is closed and its last conn is gone.
+func (l *Listener) reapLoop() {
+	t := time.NewTicker(max(l.cfg.IdleTimeout/4, 10*time.Millisecond))
+	defer t.Stop()
+	for range t.C {
+		l.mu.Lock()
+		if l.closed && len(l.conns) == 0 {
+			l.mu.Unlock()
+			return
+		}
+		conns := make([]*Conn, 0, len(l.conns))
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.mu.Unlock()
+
+		// conns lock l.mu from their callbacks, so never the other way
+		for _, c := range conns {
+			if c.idle() >= l.cfg.IdleTimeout && c.abort(syscall.ECONNABORTED) {
+				l.mu.Lock()
+				l.stats.Reaped++
+				l.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (l *Listener) port() uint16 {
+	return uint16(l.comp.LocalAddr().Port)
+}
+
+// reset answers a segment that belongs to no connection (rfc 793 p. 36).
+func (l *Listener) reset(in header.Header, payload []byte, addr *net.UDPAddr) {
+	if header.IsRst(&in) {
+		return
+	}
+	var h header.Header
+	header.SetRst(&h)
+	if header.IsAck(&in) {
+		header.SetSeq(&h, header.GetAckNum(&in))
+	} else {
+		n := uint32(len(payload))
+		if header.IsSyn(&in) {
+			n++
+		}
+		if header.IsFin(&in) {
+			n++
+		}
+		header.SetAck(&h)
+		header.SetAckNum(&h, header.GetSeq(&in)+n)
+	}
+	header.SetPorts(&h, int(l.port()), addr.Port)
+	l.comp.SendSegment(h, nil, addr)
+}
+
+func (l *Listener) queue(key string, c *Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.synRcvd, key)
+	if l.closed {
+		return false
+	}
+	select {
+	case l.accept <- c:
+		l.stats.Established++
+		return true
+	default:
+		l.stats.AcceptDenied++
+		return false
+	}
+}
+
+func (l *Listener) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, key)
+	delete(l.synRcvd, key)
+	if l.closed && len(l.conns) == 0 {
+		l.comp.Close()
+	}
+}
+
+// Stats returns a snapshot of the handshake counters.
+func (l *Listener) Stats() ListenerStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.stats
+	s.HalfOpen = len(l.synRcvd)
+	return s
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: network, Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting. connections already accepted keep running, the
+// udp socket is closed once the last of them is done.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return &net.OpError{Op: "close", Net: network, Addr: l.Addr(), Err: net.ErrClosed}
+	}
+	l.closed = true
+	close(l.done)
+	if len(l.conns) == 0 {
+		l.comp.Close()
+	}
+	l.mu.Unlock()
+
+	for {
+		select {
+		case c := <-l.accept:
+			c.Close() // never handed out
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.comp.LocalAddr()
+}
+
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
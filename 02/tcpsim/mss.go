@@ -0,0 +1,88 @@
+package tcpsim
+
+import (
+	"errors"
+
+	"tcp-sim/computer"
+	"tcp-sim/header"
+	"tcp-sim/ip"
+)
+
+const (
+	defaultMSS     = 1024 // what we advertise unless Options.MSS says else
+	defaultPeerMSS = 536  // the peer's if its SYN has no mss option (rfc 9293 3.7.1)
+	minMSS         = 256  // path mtu discovery never goes below this
+	// the biggest segment that fits a datagram we read, with room for
+	// the ip header
+	maxMSS = computer.MaxDatagram - 20 - len(header.Header{})
+
+	blackHoleTimeouts = 2 // timeouts of a full segment in a row before we suspect the mtu
+)
+
+// advertisedMSS is the mss we put in our SYN: Options.MSS within minMSS
+// and maxMSS.
+func advertisedMSS(opts Options) int {
+	if opts.MSS <= 0 {
+		return defaultMSS
+	}
+	return min(max(opts.MSS, minMSS), maxMSS)
+}
+
+// peerOptions takes the mss from the peer's SYN options. we send the
+// smaller of its mss and ours. must hold c.mu.
+func (c *Conn) peerOptions(opts []byte) {
+	c.peerMSS = defaultPeerMSS
+	if m, ok := header.GetMSS(opts); ok && m > 0 {
+		c.peerMSS = int(m)
+	}
+	c.setMSS(min(c.peerMSS, c.rcvMSS))
+}
+
+func (c *Conn) setMSS(mss int) {
+	c.mss = mss
+	c.cc.SetMSS(mss)
+}
+
+// lowerMSS makes the segments smaller after the path turned out not to
+// carry them, and sends what is unacked again at the new size. must hold
+// c.mu.
+func (c *Conn) lowerMSS(mss int, event string) {
+	mss = max(mss, minMSS)
+	if mss >= c.mss {
+		return
+	}
+	c.setMSS(mss)
+	c.mssDrops++
+	c.trace(event)
+	if c.sndNxt != c.sndUna {
+		c.sndNxt = c.sndUna // nothing bigger than mss got through
+		c.rtt.retransmitted()
+		c.output()
+	}
+}
+
+// tooBig handles an icmp fragmentation needed about one of our segments
+// (rfc 1191): the mtu in it, less the ip and tcp header, is the new mss.
+// it reports if it was one. must hold c.mu.
+func (c *Conn) tooBig(err error) bool {
+	var e *ip.ICMPError
+	if !c.opts.PMTUD || !errors.As(err, &e) || !errors.Is(err, ip.ErrFragNeeded) {
+		return false
+	}
+	c.lowerMSS(e.MTU-20-len(header.Header{}), "frag-needed")
+	return true
+}
+
+// blackHole is called when the retransmission timer fires. if full
+// segments keep timing out, the path may drop big datagrams without an
+// icmp (rfc 2923 2.1), so we try smaller ones (like linux's
+// tcp_mtu_probing). must hold c.mu.
+func (c *Conn) blackHole() {
+	if !c.opts.PMTUD || c.retries < blackHoleTimeouts || len(c.sndBuf) < c.mss || c.mss <= minMSS {
+		return
+	}
+	c.blackHoles++
+	c.setMSS(max(c.mss/2, minMSS))
+	c.mssDrops++
+	c.trace("black-hole")
+}
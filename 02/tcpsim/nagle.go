@@ -0,0 +1,101 @@
+package tcpsim
+
+import (
+	"time"
+
+	"tcp-sim/header"
+)
+
+const delAckTimeout = 200 * time.Millisecond // like linux and bsd, rfc 1122 allows up to 500ms
+
+// delayedAck holds back the ACK for in-order data, hoping it can ride on
+// data we send anyway (rfc 1122 4.2.3.2). it goes out by itself for every
+// second full segment, or when the timer fires.
+type delayedAck struct {
+	on      bool
+	pending bool // data arrived that we did not ack yet
+	full    int  // full segments since our last ACK
+	timer   *time.Timer
+	gen     int
+	fired   int // ACKs the timer sent, for Stats
+}
+
+// SetNoDelay turns Nagle's algorithm off (true) or on (false), like
+// net.TCPConn.SetNoDelay. with Nagle on, a small write waits while
+// anything we sent is unacked and is sent together with the writes after
+// it.
+func (c *Conn) SetNoDelay(noDelay bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nagle = !noDelay
+	if noDelay {
+		c.output() // send what Nagle held back
+	}
+	return nil
+}
+
+// SetDelayedAck turns delayed ACKs on or off, like TCP_QUICKACK the other
+// way round.
+func (c *Conn) SetDelayedAck(on bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delack.on = on
+	if !on && c.delack.pending {
+		c.send(header.ACK, c.sndNxt, nil)
+	}
+	return nil
+}
+
+// nagleHolds reports if the segment at seq should wait (rfc 896): it is
+// new data smaller than a full segment, and something is still unacked.
+// the FIN doesn't wait, Close flushes. must hold c.mu.
+func (c *Conn) nagleHolds(seq uint32, limit int) bool {
+	if !c.nagle || c.finQ || c.sndUna == c.sndMax || seqLT(seq, c.sndMax) {
+		return false
+	}
+	left := len(c.sndBuf) - int(seq-c.sndUna)
+	return left > 0 && left < c.mss && left <= limit
+}
+
+// ackData acks a segment of n bytes of in-order data, now or later. must
+// hold c.mu.
+func (c *Conn) ackData(n int) {
+	if !c.delack.on {
+		c.send(header.ACK, c.sndNxt, nil)
+		return
+	}
+	if n >= c.mss {
+		c.delack.full++
+	}
+	if c.delack.full >= 2 {
+		c.send(header.ACK, c.sndNxt, nil)
+		return
+	}
+	c.delack.pending = true
+	if c.delack.timer == nil {
+		gen := c.delack.gen
+		c.delack.timer = time.AfterFunc(delAckTimeout, func() { c.onDelAck(gen) })
+	}
+}
+
+// acked is called for every segment we send with an ACK, it carries the
+// delayed one. must hold c.mu.
+func (c *Conn) acked() {
+	c.delack.pending = false
+	c.delack.full = 0
+	c.delack.gen++
+	if c.delack.timer != nil {
+		c.delack.timer.Stop()
+		c.delack.timer = nil
+	}
+}
+
+func (c *Conn) onDelAck(gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.delack.gen || !c.delack.pending || c.state == stateClosed {
+		return
+	}
+	c.delack.fired++
+	c.send(header.ACK, c.sndNxt, nil)
+}
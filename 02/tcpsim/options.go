@@ -0,0 +1,93 @@
+package tcpsim
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"tcp-sim/ip"
+	"tcp-sim/netem"
+	"tcp-sim/pcap"
+)
+
+// Options are the per connection settings shared by Dialer and
+// ListenConfig. the zero value is what Dial and Listen use.
+type Options struct {
+	Network    string                          // "udp" (the default), "udp4" or "udp6"
+	Congestion func(mss int) CongestionControl // nil means NewReno
+	Trace      *Trace                          // cwnd/ssthresh csv, nil for none
+	Link       *netem.Link                     // emulated network on the send side
+	MinRTO     time.Duration                   // lower bound for the rto, 0 means 200ms
+	MaxRTO     time.Duration                   // upper bound for the rto, 0 means 60s
+	RecvWindow int                             // receive buffer size, 0 means the 65535 max
+	Capture    *pcap.Writer                    // records every segment sent and received
+	// ISN picks our initial sequence number, nil means isn.Generate
+	// (rfc 6528). a fixed one makes demos easier to read.
+	ISN func(local, remote *net.UDPAddr) uint32
+	// MSL is the maximum segment lifetime, TIME_WAIT lasts twice that.
+	// 0 means 30s.
+	MSL time.Duration
+	// KeepAlive probes an idle conn and drops it with ETIMEDOUT when the
+	// peer stops answering. off unless Enable is set, unlike net.Dialer.
+	// 0 fields get the net package defaults (15s, 15s, 9 probes).
+	KeepAlive net.KeepAliveConfig
+	// Nagle holds back small writes while data is unacked (rfc 896). off
+	// by default, like net.TCPConn, see Conn.SetNoDelay.
+	Nagle bool
+	// DelayedAck acks every second full segment, or 200ms after the
+	// data, unless a segment we send carries the ACK first.
+	DelayedAck bool
+	// Host sends through the simulated ip layer and its routers, see
+	// package ip. addresses are then the simulated ones.
+	Host *ip.Host
+	// MSS is the largest segment we take, sent in the SYN. 0 means 1024.
+	// we send segments of the smaller of ours and the peer's.
+	MSS int
+	// PMTUD makes segments smaller when the path can't carry them:
+	// after an icmp fragmentation needed (rfc 1191), or when full
+	// segments keep timing out on a path that drops them silently.
+	PMTUD bool
+	// ARQ is how lost segments are sent again, see ARQ.
+	ARQ ARQ
+	// OnRTT gets every rtt sample, for percentiles. it is called with
+	// the conn locked, so it must not call the conn.
+	OnRTT func(rtt time.Duration)
+}
+
+// Dialer dials with Options, like net.Dialer.
+type Dialer struct {
+	Options
+	// LocalAddr is the host:port to dial from, "" for any free port. two
+	// dialers that dial each other's LocalAddr at the same time do a
+	// simultaneous open.
+	LocalAddr string
+	// RetryRefused treats a refused SYN like a lost one and sends it
+	// again, for peers that dial each other and may start apart.
+	RetryRefused bool
+}
+
+// Trace writes every cwnd and ssthresh change of the conns that use it
+// as csv rows, to plot the sawtooth.
+type Trace struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+// NewTrace writes the csv header to w.
+func NewTrace(w io.Writer) *Trace {
+	fmt.Fprintln(w, "time_ms,conn,event,cwnd,ssthresh,in_flight")
+	return &Trace{w: w, start: time.Now()}
+}
+
+func (t *Trace) log(conn net.Addr, event string, cwnd, ssthresh, inFlight int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := float64(time.Since(t.start).Microseconds()) / 1000
+	fmt.Fprintf(t.w, "%.3f,%s,%s,%d,%d,%d\n", ms, conn, event, cwnd, ssthresh, inFlight)
+}
@@ -0,0 +1,92 @@
+package tcpsim
+
+// reassembly keeps the segments that arrived ahead of rcvNxt until the
+// gap before them is filled. blocks are kept sorted and never overlap, so
+// a byte is only stored once however often it was sent. seqs are compared
+// by their distance from rcvNxt, which stays right when they wrap past
+// 2^32.
+type reassembly struct {
+	blocks []block
+	fin    bool   // the FIN arrived too
+	finSeq uint32 // seq of the FIN, right after the last byte
+}
+
+type block struct {
+	seq  uint32
+	data []byte
+}
+
+func (b block) end() uint32 {
+	return b.seq + uint32(len(b.data))
+}
+
+// insert stores the parts of data at seq that are not queued yet. seq
+// must be ahead of rcvNxt and data must fit the window.
+func (r *reassembly) insert(rcvNxt, seq uint32, data []byte, fin bool) {
+	if fin {
+		r.fin = true
+		r.finSeq = seq + uint32(len(data))
+	}
+	if r.fin && seqGT(seq+uint32(len(data)), r.finSeq) {
+		// nothing comes after a FIN
+		if seqLT(r.finSeq, seq) {
+			data = nil
+		} else {
+			data = data[:r.finSeq-seq]
+		}
+	}
+
+	off := func(s uint32) uint32 { return s - rcvNxt }
+	var merged []block
+	for _, b := range r.blocks {
+		if len(data) == 0 || off(b.end()) <= off(seq) {
+			merged = append(merged, b) // all of b is before data, or data is used up
+			continue
+		}
+		if off(seq) < off(b.seq) {
+			n := min(len(data), int(b.seq-seq)) // the part of data in front of b
+			merged = append(merged, block{seq, data[:n]})
+			data = data[n:]
+			seq += uint32(n)
+		}
+		merged = append(merged, b)
+		if skip := int(b.end() - seq); len(data) > 0 && off(seq) < off(b.end()) {
+			data = data[min(skip, len(data)):] // b already has these bytes
+			seq = b.end()
+		}
+	}
+	if len(data) > 0 {
+		merged = append(merged, block{seq, data})
+	}
+	r.blocks = merged
+}
+
+// next takes the data that starts at rcvNxt off the queue, if any, and
+// reports if the FIN is right after it.
+func (r *reassembly) next(rcvNxt uint32) ([]byte, bool) {
+	// drop what the in-order segment that just came in already covered
+	for len(r.blocks) > 0 && seqLEQ(r.blocks[0].end(), rcvNxt) {
+		r.blocks = r.blocks[1:]
+	}
+	if len(r.blocks) > 0 && seqLT(r.blocks[0].seq, rcvNxt) {
+		b := r.blocks[0]
+		r.blocks[0] = block{rcvNxt, b.data[rcvNxt-b.seq:]}
+	}
+
+	var data []byte
+	if len(r.blocks) > 0 && r.blocks[0].seq == rcvNxt {
+		data = r.blocks[0].data
+		r.blocks = r.blocks[1:]
+	}
+	fin := r.fin && r.finSeq == rcvNxt+uint32(len(data))
+	return data, fin
+}
+
+// bytes is how much data is queued.
+func (r *reassembly) bytes() int {
+	n := 0
+	for _, b := range r.blocks {
+		n += len(b.data)
+	}
+	return n
+}
@@ -0,0 +1,92 @@
+package tcpsim
+
+import "time"
+
+// defaults for Options.MinRTO and MaxRTO. rfc 6298 asks for a 1 second
+// minimum, linux uses 200ms and so do we, loopback rtts are tiny.
+const (
+	initialRTO    = time.Second
+	defaultMinRTO = 200 * time.Millisecond
+	defaultMaxRTO = 60 * time.Second
+	clockGranule  = time.Millisecond // G in rfc 6298
+)
+
+// rttEstimator keeps srtt and rttvar and derives the rto from them
+// (rfc 6298). samples come from one timed segment at a time, and never
+// from a retransmitted one (karn's algorithm).
+type rttEstimator struct {
+	minRTO, maxRTO time.Duration
+
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	last    time.Duration
+	samples int
+	onRTT   func(time.Duration) // Options.OnRTT
+
+	timing  bool
+	timeSeq uint32 // sample when an ack covers this seq
+	timeAt  time.Time
+}
+
+func newRTTEstimator(minRTO, maxRTO time.Duration, onRTT func(time.Duration)) rttEstimator {
+	if minRTO <= 0 {
+		minRTO = defaultMinRTO
+	}
+	if maxRTO <= 0 {
+		maxRTO = defaultMaxRTO
+	}
+	return rttEstimator{minRTO: minRTO, maxRTO: maxRTO, rto: initialRTO, onRTT: onRTT}
+}
+
+// start times the segment ending at seq, unless one is timed already.
+func (r *rttEstimator) start(seq uint32) {
+	if !r.timing {
+		r.timing = true
+		r.timeSeq = seq
+		r.timeAt = time.Now()
+	}
+}
+
+// ack takes a sample if ack covers the timed segment.
+func (r *rttEstimator) ack(ack uint32) {
+	if r.timing && seqGEQ(ack, r.timeSeq) {
+		r.timing = false
+		r.sample(time.Since(r.timeAt))
+	}
+}
+
+// retransmitted drops the running sample, its ack would be ambiguous.
+func (r *rttEstimator) retransmitted() {
+	r.timing = false
+}
+
+func (r *rttEstimator) sample(rtt time.Duration) {
+	r.last = rtt
+	r.samples++
+	if r.onRTT != nil {
+		r.onRTT(rtt)
+	}
+	if r.samples == 1 {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+	} else {
+		diff := r.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		r.rttvar = (3*r.rttvar + diff) / 4
+		r.srtt = (7*r.srtt + rtt) / 8
+	}
+	r.rto = r.clamp(r.srtt + max(clockGranule, 4*r.rttvar))
+}
+
+// backoff doubles the rto after a timeout. it stays doubled until the
+// next valid sample.
+func (r *rttEstimator) backoff() {
+	r.rto = r.clamp(2 * r.rto)
+}
+
+func (r *rttEstimator) clamp(d time.Duration) time.Duration {
+	return min(max(d, r.minRTO), r.maxRTO)
+}
@@ -0,0 +1,20 @@
+package tcpsim
+
+// sequence numbers wrap at 2^32, so compare them through the signed
+// difference instead of directly (rfc 793 section 3.3)
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func seqGT(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func seqGEQ(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
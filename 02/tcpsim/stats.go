@@ -0,0 +1,88 @@
+package tcpsim
+
+import "time"
+
+// Stats is a snapshot of one conn, see Conn.Stats.
+type Stats struct {
+	State            string
+	SimultaneousOpen bool // the handshake was two crossing SYNs
+
+	SRTT       time.Duration // smoothed rtt
+	RTTVar     time.Duration // rtt variation
+	RTO        time.Duration // current retransmission timeout, backoff included
+	LastRTT    time.Duration // newest sample
+	RTTSamples int
+
+	Cwnd     int
+	Ssthresh int
+	InFlight int
+	SndWnd   int // window the peer advertised
+	RcvWnd   int // free space in our receive buffer
+	Unsent   int // queued bytes not sent yet
+
+	MSS           int // payload bytes per segment we send
+	PeerMSS       int // from the peer's SYN, 536 if it had none
+	MSSReductions int // path mtu discovery made MSS smaller
+	BlackHoles    int // of those, because full segments kept timing out
+
+	OutOfOrder int // segments that arrived ahead of a gap
+	Reassembly int // bytes waiting for a gap to be filled
+
+	SegmentsSent     int
+	DataSegmentsSent int // segments with payload
+	AcksSent         int // pure ACKs: no data, SYN or FIN
+	DelayedAcks      int // pure ACKs sent by the delayed ACK timer
+	SegmentsReceived int
+	AcksReceived     int // pure ACKs
+
+	BytesSent          int // payload, retransmissions included
+	Retransmits        int // data segments sent again
+	RetransmittedBytes int
+
+	Timeouts         int
+	FastRetransmits  int
+	ZeroWindowProbes int
+	KeepAliveProbes  int
+	OldSegments      int // dropped in TIME_WAIT
+}
+
+// Stats returns the live estimates and counters of c.
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		State:              c.state.String(),
+		SimultaneousOpen:   c.simOpen,
+		SRTT:               c.rtt.srtt,
+		RTTVar:             c.rtt.rttvar,
+		RTO:                c.rtt.rto,
+		LastRTT:            c.rtt.last,
+		RTTSamples:         c.rtt.samples,
+		Cwnd:               c.cc.Cwnd(),
+		Ssthresh:           c.cc.Ssthresh(),
+		InFlight:           int(c.sndMax - c.sndUna),
+		SndWnd:             int(c.sndWnd),
+		RcvWnd:             c.rcvWindow(),
+		Unsent:             max(0, len(c.sndBuf)-int(c.sndNxt-c.sndUna)),
+		MSS:                c.mss,
+		PeerMSS:            c.peerMSS,
+		MSSReductions:      c.mssDrops,
+		BlackHoles:         c.blackHoles,
+		OutOfOrder:         c.outOfOrder,
+		Reassembly:         c.reasm.bytes(),
+		SegmentsSent:       c.segsSent,
+		DataSegmentsSent:   c.dataSent,
+		AcksSent:           c.acksSent,
+		DelayedAcks:        c.delack.fired,
+		SegmentsReceived:   c.segsRcvd,
+		AcksReceived:       c.acksRcvd,
+		BytesSent:          c.dataBytes,
+		Retransmits:        c.rexmits,
+		RetransmittedBytes: c.rexmitBytes,
+		Timeouts:           c.timeouts,
+		FastRetransmits:    c.fastRetransmits,
+		ZeroWindowProbes:   c.probes,
+		KeepAliveProbes:    c.ka.sent,
+		OldSegments:        c.oldSegments,
+	}
+}
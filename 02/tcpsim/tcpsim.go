@@ -0,0 +1,114 @@
+// Package tcpsim puts a net.Conn and net.Listener on top of the simulated
+// tcp from the computer and header packages, so ordinary go code (io.Copy,
+// bufio, net/http) can run over it. segments are still carried over udp.
+package tcpsim
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+
+	"tcp-sim/computer"
+	"tcp-sim/header"
+	"tcp-sim/ip"
+)
+
+const network = "tcpsim"
+
+// checkAddr checks addr is host:port, like net.Dial wants it.
+func checkAddr(op, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil {
+		return &net.OpError{Op: op, Net: network, Err: err}
+	}
+	return nil
+}
+
+// Dial does the 3-way handshake with a Listener at addr and returns the
+// established connection.
+func Dial(addr string) (net.Conn, error) {
+	var d Dialer
+	return d.Dial(addr)
+}
+
+// Dial is like the package Dial but with the options in d.
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	if err := checkAddr("dial", addr); err != nil {
+		return nil, err
+	}
+	if d.LocalAddr != "" {
+		if err := checkAddr("dial", d.LocalAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	comp, err := computer.New(computer.Config{Addr: addr, BindAddr: d.LocalAddr, Network: d.Network, Link: d.Link, Capture: d.Capture, Host: d.Host})
+	if err == nil {
+		err = comp.Dial()
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	c := newConn(comp, nil, comp.RemoteAddr(), d.Options)
+	c.onDone = func(*Conn) { comp.Close() }
+	go func() {
+		for {
+			h, rest, _, err := comp.ReadSegment(context.Background())
+			if err != nil {
+				if isClosedErr(err) {
+					return
+				}
+				if errors.Is(err, syscall.ECONNREFUSED) && !d.RetryRefused {
+					c.refused() // icmp port unreachable, nobody listens
+				}
+				var icmp *ip.ICMPError
+				if errors.As(err, &icmp) {
+					c.unreachable(icmp)
+				}
+				continue
+			}
+			opts, payload := header.SplitOptions(&h, rest)
+			c.input(h, opts, payload)
+		}
+	}()
+
+	err = c.activeOpen()
+	if err != nil {
+		return nil, c.opError("dial", err)
+	}
+	return c, nil
+}
+
+// Listen opens the udp socket for addr and accepts handshakes on it.
+func Listen(addr string) (net.Listener, error) {
+	var lc ListenConfig
+	return lc.Listen(addr)
+}
+
+// Listen is like the package Listen but with the options in lc.
+func (lc *ListenConfig) Listen(addr string) (net.Listener, error) {
+	if err := checkAddr("listen", addr); err != nil {
+		return nil, err
+	}
+
+	comp, err := computer.New(computer.Config{Addr: addr, Network: lc.Network, Link: lc.Link, Capture: lc.Capture, Host: lc.Host})
+	if err == nil {
+		err = comp.Listen()
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	l := newListener(comp, *lc)
+	go l.readLoop()
+	if lc.IdleTimeout > 0 {
+		go l.reapLoop()
+	}
+	return l, nil
+}
@@ -0,0 +1,128 @@
+// Package causal delivers chat events in causal order. an event is held
+// back until every event its vector clock says its sender had seen was
+// delivered, so a reply never shows up before the message it answers.
+package causal
+
+import (
+	"time"
+
+	pb "chitchat/grpc"
+	"chitchat/vclock"
+)
+
+// Holdback is the queue of events that arrived too early. it is not safe
+// for concurrent use.
+type Holdback struct {
+	delivered vclock.Clock
+	held      []held
+}
+
+type held struct {
+	ev *pb.Event
+	at time.Time
+}
+
+// NewHoldback starts from the clock of what is already known, like the
+// one in the join reply. events covered by it are not waited for.
+func NewHoldback(delivered vclock.Clock) *Holdback {
+	d := delivered.Copy()
+	if d == nil {
+		d = make(vclock.Clock)
+	}
+	return &Holdback{delivered: d}
+}
+
+// Add takes an event that arrived at now and returns the events that can
+// be delivered because of it, in order. that is none if ev has to wait,
+// or ev and the held ones that waited for it.
+func (h *Holdback) Add(ev *pb.Event, now time.Time) []*pb.Event {
+	h.held = append(h.held, held{ev, now})
+	return h.release()
+}
+
+// Expire gives up waiting for events that were lost: an event held for
+// longer than maxAge is delivered anyway, oldest lamport time first, and
+// so is everything that only waited for it.
+func (h *Holdback) Expire(now time.Time, maxAge time.Duration) []*pb.Event {
+	var out []*pb.Event
+	for {
+		i := h.next(func(x held) bool { return now.Sub(x.at) > maxAge })
+		if i < 0 {
+			return out
+		}
+		out = append(out, h.deliver(i))
+		out = append(out, h.release()...)
+	}
+}
+
+// Flush delivers everything that is held, by lamport time, for when
+// nothing more will come.
+func (h *Holdback) Flush() []*pb.Event {
+	return h.Expire(time.Now(), -1)
+}
+
+// Len is how many events are held.
+func (h *Holdback) Len() int {
+	return len(h.held)
+}
+
+// Missing is what ev still waits for: the entries of its clock beyond
+// what was delivered. empty if it is deliverable.
+func (h *Holdback) Missing(ev *pb.Event) vclock.Clock {
+	out := make(vclock.Clock)
+	for id, n := range ev.GetVectorClock() {
+		if n > h.limit(ev, id) {
+			out[id] = n
+		}
+	}
+	return out
+}
+
+// ready says if every event ev depends on was delivered. the sender's
+// own entry may be one ahead, that one is ev itself.
+func (h *Holdback) ready(ev *pb.Event) bool {
+	for id, n := range ev.GetVectorClock() {
+		if n > h.limit(ev, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Holdback) limit(ev *pb.Event, id uint64) uint64 {
+	if id == ev.GetClientId() {
+		return h.delivered[id] + 1
+	}
+	return h.delivered[id]
+}
+
+// release delivers held events while any is ready.
+func (h *Holdback) release() []*pb.Event {
+	var out []*pb.Event
+	for {
+		i := h.next(func(x held) bool { return h.ready(x.ev) })
+		if i < 0 {
+			return out
+		}
+		out = append(out, h.deliver(i))
+	}
+}
+
+// next is the held event with the lowest lamport time that ok accepts,
+// -1 for none.
+func (h *Holdback) next(ok func(held) bool) int {
+	best := -1
+	for i, x := range h.held {
+		if ok(x) && (best < 0 || x.ev.GetLamport() < h.held[best].ev.GetLamport()) {
+			best = i
+		}
+	}
+	return best
+}
+
+func (h *Holdback) deliver(i int) *pb.Event {
+	ev := h.held[i].ev
+	h.held = append(h.held[:i], h.held[i+1:]...)
+	h.delivered.Merge(ev.GetVectorClock())
+	return ev
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	pb "chitchat/grpc"
+)
+
+// sessionToken is sent with every call once Login gave us one.
+var sessionToken string
+
+// bearer puts the session token in the metadata of every call.
+type bearer struct{}
+
+func (bearer) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if sessionToken == "" {
+		return nil, nil // Register and Login
+	}
+	return map[string]string{"authorization": "Bearer " + sessionToken}, nil
+}
+
+// the server runs without tls, like everything else here
+func (bearer) RequireTransportSecurity() bool { return false }
+
+// login registers the user first if register is set, then logs in with
+// the password, or the login token if there is no password.
+func login(ctx context.Context, client pb.EchoClient, user, password, token string, register bool) error {
+	if register {
+		resp, err := client.Register(ctx, &pb.RegisterRequest{Username: user, Password: password})
+		if err != nil {
+			return err
+		}
+		log.Printf("[CLIENT] [REGISTER ok user=%s] [login_token=%s]", user, resp.GetLoginToken())
+	}
+
+	req := &pb.LoginRequest{Username: user}
+	if password != "" {
+		req.Secret = &pb.LoginRequest_Password{Password: password}
+	} else {
+		req.Secret = &pb.LoginRequest_LoginToken{LoginToken: token}
+	}
+	resp, err := client.Login(ctx, req)
+	if err != nil {
+		return err
+	}
+	sessionToken = resp.GetSessionToken()
+	log.Printf("[CLIENT] [LOGIN ok user=%s]", user)
+	return nil
+}
@@ -3,27 +3,90 @@ package main
 import (
 	"bufio"
 	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 
+	"chitchat/causal"
 	pb "chitchat/grpc"
+	"chitchat/vclock"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 )
 
 var id uint64
 var clock uint64
 var joined bool
 
+// room is what we keep for a room we are in. every room has its own
+// lamport and vector clocks on the server.
+type room struct {
+	// vc is our vector clock: what we received, and our own messages.
+	// the clocks in the publish and leave replies are not merged, they
+	// cover messages we may not have received yet.
+	vc vclock.Clock
+
+	// hb holds back the events that arrived before ones they depend on,
+	// for at most holdFor. 0 shows them as they come.
+	hb *causal.Holdback
+
+	// the last message we showed, to say how the next one relates to it
+	prevMsg *pb.Event
+}
+
+func newRoom(joinVC map[uint64]uint64) *room {
+	vc := vclock.Clock(joinVC).Copy()
+	if vc == nil {
+		vc = make(vclock.Clock)
+	}
+	return &room{vc: vc, hb: causal.NewHoldback(vc)}
+}
+
+// rooms are the ones we are in, current is where we post
+var rooms = map[string]*room{}
+var current = generalRoom
+
+var holdFor time.Duration
+
+// since is where the next join of a room starts replaying its history,
+// nil for no replay. after the first event it is the last lamport time
+// we saw there, so a rejoin only gets what it missed. sinceFlag is for
+// the rooms we haven't seen yet.
+var since = map[string]*uint64{}
+var sinceFlag *uint64
+
+// toAck is the last live event we got and haven't acked yet
+var toAck *pb.Event
+
 var evCh = make(chan *pb.Event, 32)
 var inCh = make(chan string, 1)
 
 func main() {
-	addr := "127.0.0.1:50051"
+	addr := flag.String("addr", "127.0.0.1:50051", "server address, or the addresses of a cluster's replicas, comma separated")
+	history := flag.Int64("since", 0, "replay the history after this lamport time first, -1 for none")
+	flag.DurationVar(&holdFor, "holdback", 2*time.Second, "how long an event waits for the ones it depends on, 0 for no waiting")
+	user := flag.String("user", "", "username to log in as")
+	password := flag.String("password", os.Getenv("CHITCHAT_PASSWORD"), "password, default $CHITCHAT_PASSWORD")
+	token := flag.String("token", "", "login token from -register, instead of the password")
+	register := flag.Bool("register", false, "register -user with -password first")
+	flag.DurationVar(&reconnectFor, "reconnect", time.Minute, "how long to try to resume a broken stream, 0 for not at all")
+	flag.Parse()
+	if *user == "" || *password == "" && *token == "" {
+		log.Fatalf("[CLIENT] [LOGIN_ERROR] [need -user, and -password or -token]")
+	}
+	if *history >= 0 {
+		sinceFlag = new(uint64)
+		*sinceFlag = uint64(*history)
+	}
 
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := dial(*addr)
 	if err != nil {
 		log.Fatalf("[CLIENT] [DIAL_ERROR] [%v]", err)
 	}
@@ -33,6 +96,10 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
+	if err := login(ctx, client, *user, *password, *token, *register); err != nil {
+		log.Fatalf("[CLIENT] [LOGIN_ERROR] [%v]", err)
+	}
+
 	joinResp, err := client.Join(ctx, &pb.JoinRequest{Clock: 0})
 	if err != nil {
 		log.Fatalf("[CLIENT] [JOIN_ERROR] [SERVER NOT STARTED]")
@@ -40,9 +107,12 @@ func main() {
 
 	id = joinResp.ClientId
 	clock = joinResp.ServerClock
+	resumeToken = joinResp.GetResumeToken()
+	rooms = map[string]*room{generalRoom: newRoom(joinResp.GetVectorClock())}
+	current = generalRoom
 	joined = true
 
-	sub, err := client.Subscribe(context.Background(), &pb.SubscribeRequest{ClientId: id, Clock: clock})
+	sub, err := subscribe(client)
 	if err != nil {
 		log.Fatalf("[CLIENT] [SUBSCRIBE_ERROR] [%v]", err)
 	}
@@ -50,8 +120,20 @@ func main() {
 	go listenForStream(sub)
 	go listenForInput()
 
+	expire := time.NewTicker(100 * time.Millisecond)
+	defer expire.Stop()
+
 	for {
 		select {
+		case now := <-expire.C:
+			ack(client)
+			for _, r := range rooms {
+				for _, ev := range r.hb.Expire(now, holdFor) {
+					log.Printf("[CLIENT] [HOLDBACK_GAVE_UP L=%d from=%d] [room=%s]", ev.GetLamport(), ev.GetClientId(), roomOf(ev))
+					deliver(r, ev)
+				}
+			}
+
 		case line, ok := <-inCh:
 			if !ok {
 				log.Printf("[CLIENT] [STDIN_CLOSED]")
@@ -64,21 +146,174 @@ func main() {
 				log.Printf("[CLIENT] [STREAM_CLOSED]")
 				return
 			}
-			newClock := clock
-			if ev.Lamport > newClock {
-				newClock = ev.GetLamport()
+			if ev.GetType() == pb.EventType_EVENT_DROPPED {
+				log.Printf("[CLIENT] [DROPPED] [%s]", ev.GetText())
+				continue
+			}
+			if !ev.GetReplayed() {
+				toAck = ev
+				lastLive = ev
 			}
-			newClock++
-			clock = newClock
-			log.Println(ev.Text)
+			receive(ev)
+
+		case <-brokeCh:
+			if !joined || reconnectFor <= 0 {
+				continue
+			}
+			log.Printf("[CLIENT] [RECONNECTING id=%d] [after=%s L=%d]", id, roomOf(lastLive), lastLive.GetLamport())
+			go reconnect(client, id, resumeToken, lastLive)
+
+		case res := <-resumedCh:
+			if !joined || res.id != id {
+				continue // we left in the meantime
+			}
+			if res.err != nil {
+				log.Printf("[CLIENT] [RESUME_FAILED] [%v] type 'join' to join again", res.err)
+				for _, r := range rooms {
+					flush(r)
+				}
+				rooms = map[string]*room{}
+				joined = false
+				continue
+			}
+			log.Printf("[CLIENT] [RESUMED id=%d]", id)
+			go listenForStream(res.sub)
 		}
 	}
 }
 
+// subscribe opens our stream. the server sends the headers once our join
+// event is logged; until then a message of ours could come before it.
+// a stream that failed shows in Recv.
+func subscribe(client pb.EchoClient) (grpc.ServerStreamingClient[pb.Event], error) {
+	sub, err := client.Subscribe(context.Background(), &pb.SubscribeRequest{ClientId: id, Clock: clock, SinceLamport: sinceOf(generalRoom)})
+	if err != nil {
+		return nil, err
+	}
+	sub.Header()
+	return sub, nil
+}
+
+// dial connects to the first of the replicas in addrs that answers, and
+// to the next one when it goes away. they all have the same events.
+func dial(addrs string) (*grpc.ClientConn, error) {
+	r := manual.NewBuilderWithScheme("chitchat")
+	var state resolver.State
+	for _, a := range strings.Split(addrs, ",") {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: strings.TrimSpace(a)})
+	}
+	r.InitialState(state)
+	return grpc.NewClient(r.Scheme()+":///replicas",
+		grpc.WithResolvers(r),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(bearer{}))
+}
+
+// ack tells the server we got everything up to the last live event, so
+// it doesn't count us as lagging.
+func ack(client pb.EchoClient) {
+	if toAck == nil || !joined {
+		return
+	}
+	ev := toAck
+	toAck = nil
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := client.Ack(ctx, &pb.AckRequest{ClientId: id, Room: ev.GetRoom(), Lamport: ev.GetLamport()}); err != nil {
+		log.Printf("[CLIENT] [ACK_ERROR] [%v]", err)
+	}
+}
+
+// receive passes an event through its room's holdback queue. the
+// replayed history goes through it too, a join can be concurrent with
+// the events at its end.
+func receive(ev *pb.Event) {
+	if ev.GetLamport() > clock {
+		clock = ev.GetLamport()
+	}
+	clock++
+	name := roomOf(ev)
+	if s := since[name]; s == nil || ev.GetLamport() > *s {
+		last := ev.GetLamport()
+		since[name] = &last
+	}
+
+	r := rooms[name]
+	if r == nil {
+		return // from a room we left, still on the way
+	}
+	if holdFor <= 0 {
+		deliver(r, ev)
+		return
+	}
+	out := r.hb.Add(ev, time.Now())
+	if len(out) == 0 {
+		log.Printf("[CLIENT] [HOLDBACK L=%d from=%d] [room=%s] [missing=%v] [held=%d]", ev.GetLamport(), ev.GetClientId(), name, r.hb.Missing(ev), r.hb.Len())
+	}
+	for _, ev := range out {
+		deliver(r, ev)
+	}
+}
+
+func deliver(r *room, ev *pb.Event) {
+	r.vc.Merge(ev.GetVectorClock())
+	show(r, ev)
+}
+
+// flush shows what a room still holds back, when nothing more comes.
+func flush(r *room) {
+	for _, ev := range r.hb.Flush() {
+		deliver(r, ev)
+	}
+}
+
+// show prints an event with its vector clock, and the room if it isn't
+// the general one. a message also says if it came after the message
+// before it, or concurrently with it: then its sender had not seen that
+// one yet.
+func show(r *room, ev *pb.Event) {
+	text := ev.GetText()
+	if name := roomOf(ev); name != generalRoom {
+		text = "[#" + name + "] " + text
+	}
+	if ev.GetReplayed() {
+		text = "[HISTORY] " + text
+	}
+	evVC := vclock.Clock(ev.GetVectorClock())
+	if ev.GetType() != pb.EventType_EVENT_USER_MSG {
+		log.Printf("%s [vc=%v]", text, evVC)
+		return
+	}
+	rel := ""
+	if r.prevMsg != nil {
+		switch vclock.Compare(r.prevMsg.GetVectorClock(), evVC) {
+		case vclock.Before:
+			rel = fmt.Sprintf(" [after msg from %s]", who(r.prevMsg))
+		case vclock.Concurrent:
+			rel = fmt.Sprintf(" [concurrent with msg from %s]", who(r.prevMsg))
+		}
+	}
+	r.prevMsg = ev
+	log.Printf("%s [vc=%v]%s", text, evVC, rel)
+}
+
+// who is the sender of ev, by user if it has one
+func who(ev *pb.Event) string {
+	if ev.GetUser() != "" {
+		return ev.GetUser()
+	}
+	return fmt.Sprint(ev.GetClientId())
+}
+
 func listenForStream(sub grpc.ServerStreamingClient[pb.Event]) {
 	for {
 		ev, err := sub.Recv()
 		if err != nil {
+			// a clean end is our own leave, anything else we resume
+			if err != io.EOF {
+				log.Printf("[CLIENT] [STREAM_CLOSED] [%v]", err)
+				brokeCh <- struct{}{}
+			}
 			return
 		}
 		evCh <- ev
@@ -92,7 +327,7 @@ func listenForInput() {
 			inCh <- sc.Text()
 		}
 	}()
-	log.Printf("\"leave\" to leave; anything else to post")
+	log.Printf("\"leave\" to leave; \"/join #room\", \"/leave #room\" and \"/rooms\" for rooms; anything else to post")
 }
 
 func handleIn(line string, client pb.EchoClient) {
@@ -103,6 +338,9 @@ func handleIn(line string, client pb.EchoClient) {
 			return
 		}
 		clock++
+		for _, r := range rooms {
+			r.vc[id]++
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		_, err := client.Leave(ctx, &pb.LeaveRequest{ClientId: id, Clock: clock})
 		cancel()
@@ -111,6 +349,11 @@ func handleIn(line string, client pb.EchoClient) {
 		} else {
 			log.Printf("[CLIENT] [LEAVE ok]")
 		}
+		// nothing more comes for the held ones
+		for _, r := range rooms {
+			flush(r)
+		}
+		rooms = map[string]*room{}
 		joined = false
 		return
 
@@ -128,24 +371,28 @@ func handleIn(line string, client pb.EchoClient) {
 		}
 		id = resp.GetClientId()
 		clock = resp.GetServerClock()
+		resumeToken = resp.GetResumeToken()
+		lastLive = nil
+		rooms = map[string]*room{generalRoom: newRoom(resp.GetVectorClock())}
+		current = generalRoom
 
-		sub, err := client.Subscribe(context.Background(), &pb.SubscribeRequest{ClientId: id, Clock: clock})
+		sub, err := subscribe(client)
 		if err != nil {
 			log.Printf("[CLIENT] [SUBSCRIBE_ERROR] [%v]", err)
 			return
 		}
-		go func() {
-			for {
-				ev, err := sub.Recv()
-				if err != nil {
-					return
-				}
-				evCh <- ev
-			}
-		}()
+		go listenForStream(sub)
 		joined = true
 		log.Printf("[CLIENT] [JOIN ok id=%d] [server_clock=%d]", id, clock)
 		return
+
+	case strings.HasPrefix(line, "/"):
+		if !joined {
+			log.Println("[CLIENT] not joined; type 'join' first")
+			return
+		}
+		roomCommand(line, client)
+		return
 	}
 
 	if len([]rune(line)) > 128 {
@@ -157,12 +404,16 @@ func handleIn(line string, client pb.EchoClient) {
 		return
 	}
 
+	r := rooms[current]
 	clock++
+	r.vc[id]++
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	_, err := client.Publish(ctx, &pb.PublishRequest{
-		ClientId: id,
-		Text:     line,
-		Clock:    clock,
+		ClientId:    id,
+		Text:        line,
+		Clock:       clock,
+		VectorClock: r.vc.Copy(),
+		Room:        current,
 	})
 	cancel()
 	if err != nil {
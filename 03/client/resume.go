@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resumeToken is from our Join, to resume our stream when it breaks
+var resumeToken string
+
+// lastLive is the last live event we got, a resumed stream goes on
+// after it
+var lastLive *pb.Event
+
+var reconnectFor time.Duration
+
+// brokeCh says our stream broke, resumedCh how resuming it went
+var brokeCh = make(chan struct{}, 1)
+var resumedCh = make(chan resumed, 1)
+
+type resumed struct {
+	id  uint64 // the participant it was for, we may have left since
+	sub grpc.ServerStreamingClient[pb.Event]
+	err error
+}
+
+// reconnect resumes the stream of participant id, with backoff, until
+// the server takes it, says no, or reconnectFor is over. it runs on its
+// own, so it gets copies of what it needs.
+func reconnect(client pb.EchoClient, id uint64, token string, last *pb.Event) {
+	req := &pb.SubscribeRequest{
+		ClientId:    id,
+		ResumeToken: token,
+		LastRoom:    last.GetRoom(),
+		LastLamport: last.GetLamport(),
+	}
+	deadline := time.Now().Add(reconnectFor)
+	wait := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		// jittered, so the clients of a server that was away don't all
+		// come back at once
+		time.Sleep(wait/2 + rand.N(wait/2))
+		sub, err := resume(client, req)
+		if err == nil {
+			resumedCh <- resumed{id: id, sub: sub}
+			return
+		}
+		log.Printf("[CLIENT] [RECONNECT attempt=%d] [%v]", attempt, err)
+		code := status.Code(err)
+		if code != codes.Unavailable && code != codes.DeadlineExceeded || time.Now().After(deadline) {
+			resumedCh <- resumed{id: id, err: err}
+			return
+		}
+		wait = min(2*wait, 8*time.Second)
+	}
+}
+
+// resume subscribes with the resume token. the server sends the headers
+// once it resumed us; Header doesn't return the error of a failed
+// stream, Recv does.
+func resume(client pb.EchoClient, req *pb.SubscribeRequest) (grpc.ServerStreamingClient[pb.Event], error) {
+	sub, err := client.Subscribe(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	md, _ := sub.Header()
+	if len(md.Get("chitchat-resumed")) > 0 {
+		return sub, nil
+	}
+	if _, err := sub.Recv(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("stream not resumed")
+}
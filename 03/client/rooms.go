@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// generalRoom is the one Join puts us in. events from before rooms have
+// no room, they are from there too.
+const generalRoom = "general"
+
+func roomOf(ev *pb.Event) string {
+	if ev.GetRoom() == "" {
+		return generalRoom
+	}
+	return ev.GetRoom()
+}
+
+// sinceOf is where the history of a room starts when we join it.
+func sinceOf(name string) *uint64 {
+	if s := since[name]; s != nil {
+		return s
+	}
+	return sinceFlag
+}
+
+// roomCommand runs "/join #room", "/leave [#room]" and "/rooms".
+func roomCommand(line string, client pb.EchoClient) {
+	args := strings.Fields(line)
+	name := current
+	if len(args) > 1 {
+		name = strings.TrimPrefix(args[1], "#")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	switch args[0] {
+	case "/rooms":
+		resp, err := client.ListRooms(ctx, &pb.ListRoomsRequest{Clock: clock})
+		if err != nil {
+			log.Printf("[CLIENT] [ROOMS_ERROR] [%v]", err)
+			return
+		}
+		for _, r := range resp.GetRooms() {
+			mark := ""
+			switch {
+			case r.GetName() == current:
+				mark = " [current]"
+			case rooms[r.GetName()] != nil:
+				mark = " [joined]"
+			}
+			log.Printf("[CLIENT] [ROOM #%s] [members=%d] [L=%d]%s", r.GetName(), r.GetMembers(), r.GetLamport(), mark)
+		}
+
+	case "/join":
+		if len(args) < 2 {
+			log.Println("[CLIENT] usage: /join #room")
+			return
+		}
+		if rooms[name] != nil {
+			current = name
+			log.Printf("[CLIENT] [ROOM #%s] [current]", name)
+			return
+		}
+		resp, err := joinRoom(ctx, client, name)
+		if status.Code(err) == codes.NotFound {
+			clock++
+			_, err = client.CreateRoom(ctx, &pb.CreateRoomRequest{ClientId: id, Name: name, Clock: clock})
+			if err == nil || status.Code(err) == codes.AlreadyExists {
+				log.Printf("[CLIENT] [CREATE_ROOM ok #%s]", name)
+				resp, err = joinRoom(ctx, client, name)
+			}
+		}
+		if err != nil {
+			log.Printf("[CLIENT] [JOIN_ROOM_ERROR #%s] [%v]", name, err)
+			return
+		}
+		clock = max(clock, resp.GetServerClock())
+		rooms[name] = newRoom(resp.GetVectorClock())
+		current = name
+		log.Printf("[CLIENT] [JOIN_ROOM ok #%s] [server_clock=%d] [history=%d]", name, resp.GetServerClock(), len(resp.GetHistory()))
+		// the history comes before the live events, which wait in evCh
+		for _, ev := range resp.GetHistory() {
+			receive(ev)
+		}
+
+	case "/leave":
+		r := rooms[name]
+		if r == nil {
+			log.Printf("[CLIENT] not in #%s", name)
+			return
+		}
+		if name == generalRoom {
+			log.Println("[CLIENT] \"leave\" leaves #general and everything else")
+			return
+		}
+		clock++
+		r.vc[id]++
+		_, err := client.LeaveRoom(ctx, &pb.LeaveRoomRequest{ClientId: id, Room: name, Clock: clock})
+		if err != nil {
+			log.Printf("[CLIENT] [LEAVE_ROOM_ERROR #%s] [%v]", name, err)
+			return
+		}
+		flush(r)
+		delete(rooms, name)
+		if current == name {
+			current = generalRoom
+		}
+		log.Printf("[CLIENT] [LEAVE_ROOM ok #%s] [current=#%s]", name, current)
+
+	default:
+		log.Printf("[CLIENT] unknown command %s; try /join #room, /leave #room or /rooms", args[0])
+	}
+}
+
+func joinRoom(ctx context.Context, client pb.EchoClient, name string) (*pb.JoinRoomReply, error) {
+	clock++
+	return client.JoinRoom(ctx, &pb.JoinRoomRequest{ClientId: id, Room: name, Clock: clock, SinceLamport: sinceOf(name)})
+}
@@ -0,0 +1,77 @@
+package raft
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"strconv"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// the replicas talk to each other on a listener of their own, not the
+// clients'. every call carries the secret the cluster shares and the id
+// of the replica that makes it.
+const (
+	secretKey  = "chitchat-cluster-secret"
+	replicaKey = "chitchat-replica"
+)
+
+// peerCreds puts the secret and our id on every call to another replica.
+type peerCreds struct {
+	id     uint64
+	secret string
+}
+
+func (c peerCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{secretKey: c.secret, replicaKey: strconv.FormatUint(c.id, 10)}, nil
+}
+
+// RequireTransportSecurity is false: the replicas talk in plain text, on
+// a network of their own.
+func (peerCreds) RequireTransportSecurity() bool { return false }
+
+type peerKey struct{}
+
+// peerOf is the replica that made the call, from authenticate.
+func peerOf(ctx context.Context) uint64 {
+	id, _ := ctx.Value(peerKey{}).(uint64)
+	return id
+}
+
+// Server returns a grpc server with the Replica service of n, for the
+// listener only the other replicas should reach.
+func (n *Node) Server() *grpc.Server {
+	gs := grpc.NewServer(grpc.UnaryInterceptor(n.authenticate))
+	pb.RegisterReplicaServer(gs, n)
+	return gs
+}
+
+// authenticate lets a call through if it has the cluster's secret and
+// comes from another replica of the cluster.
+func (n *Node) authenticate(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	secrets, ids := md.Get(secretKey), md.Get(replicaKey)
+	if len(secrets) != 1 || len(ids) != 1 {
+		log.Printf("[RAFT] [PEER_DENIED] [method=%s] [no credentials]", info.FullMethod)
+		return nil, status.Errorf(codes.Unauthenticated, "not a replica of the cluster")
+	}
+	// compared as hashes, so the time doesn't tell the length either
+	sum := sha256.Sum256([]byte(secrets[0]))
+	if subtle.ConstantTimeCompare(sum[:], n.secret[:]) != 1 {
+		log.Printf("[RAFT] [PEER_DENIED] [method=%s] [wrong secret]", info.FullMethod)
+		return nil, status.Errorf(codes.Unauthenticated, "not a replica of the cluster")
+	}
+	from, err := strconv.ParseUint(ids[0], 10, 64)
+	if err != nil || n.peers[from] == nil {
+		log.Printf("[RAFT] [PEER_DENIED] [method=%s] [replica=%s]", info.FullMethod, ids[0])
+		return nil, status.Errorf(codes.PermissionDenied, "replica %s is not in the cluster", ids[0])
+	}
+	return handler(context.WithValue(ctx, peerKey{}, from), req)
+}
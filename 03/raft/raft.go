@@ -0,0 +1,632 @@
+// Package raft keeps a log of commands that a cluster of replicas agrees
+// on, with the raft consensus algorithm (Ongaro and Ousterhout, "In
+// Search of an Understandable Consensus Algorithm", 2014): a leader is
+// elected by a majority, it replicates its log to the others, and an
+// entry is committed once a majority has it. every replica applies the
+// committed entries in log order, so they all go through the same
+// states. a cluster of 2f+1 replicas goes on as long as f+1 of them are
+// up and can reach each other.
+//
+// there are no snapshots and no membership changes: the log grows for
+// ever, and the cluster is the one given at startup.
+package raft
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	heartbeat = 50 * time.Millisecond
+	// a follower that hears from no leader for a random time in between
+	// starts an election
+	electionMin = 300 * time.Millisecond
+	electionMax = 600 * time.Millisecond
+
+	rpcTimeout = 250 * time.Millisecond
+	maxBatch   = 256       // entries per AppendEntries
+	maxBytes   = 256 << 10 // and about their size, grpc takes 4MB
+)
+
+// ErrNotLeader is from Propose on a replica that isn't the leader.
+var ErrNotLeader = errors.New("not the leader")
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Node is one replica. it serves the Replica service to the others.
+type Node struct {
+	pb.UnimplementedReplicaServer
+
+	id     uint64
+	secret [sha256.Size]byte           // of the secret the replicas share
+	peers  map[uint64]pb.ReplicaClient // the other replicas
+	kicks  map[uint64]chan struct{}    // wakes the leader's sender to each
+	store  *storage
+	apply  func(*pb.Entry)
+
+	mu          sync.Mutex
+	applied     *sync.Cond // signalled when commit or lastApplied moves
+	term        uint64
+	votedFor    uint64
+	log         []*pb.Entry // log[i].Index is i, log[0] is a placeholder
+	commit      uint64
+	lastApplied uint64 // apply returned for the entries up to it
+	role        role
+	leader      uint64    // 0 while there is none we know of
+	deadline    time.Time // of the election timeout
+	next        map[uint64]uint64
+	match       map[uint64]uint64
+}
+
+// Open starts replica id of the cluster in cluster, by id, with its
+// state in dir. the replicas know each other by secret, which a cluster
+// of more than one must have. apply is called with every committed
+// entry, in order, on a goroutine of its own; an entry may come again
+// after a restart, all of them do.
+func Open(id uint64, cluster map[uint64]string, dir, secret string, apply func(*pb.Entry)) (*Node, error) {
+	if _, ok := cluster[id]; !ok {
+		return nil, fmt.Errorf("replica %d is not in the cluster", id)
+	}
+	if len(cluster) > 1 && secret == "" {
+		return nil, errors.New("a cluster needs a secret")
+	}
+	store, hs, entries, err := openStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		id:       id,
+		secret:   sha256.Sum256([]byte(secret)),
+		peers:    make(map[uint64]pb.ReplicaClient),
+		kicks:    make(map[uint64]chan struct{}),
+		store:    store,
+		apply:    apply,
+		term:     hs.Term,
+		votedFor: hs.Vote,
+		log:      entries,
+		next:     make(map[uint64]uint64),
+		match:    make(map[uint64]uint64),
+	}
+	n.applied = sync.NewCond(&n.mu)
+	for p, addr := range cluster {
+		if p == id {
+			continue
+		}
+		// a replica that comes back must hear the leader before its
+		// election timeout, grpc's own backoff goes up to 2 minutes
+		conn, err := grpc.NewClient(addr,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(peerCreds{id: id, secret: secret}),
+			grpc.WithConnectParams(grpc.ConnectParams{
+				Backoff:           backoff.Config{BaseDelay: heartbeat, Multiplier: 1.6, MaxDelay: 2 * heartbeat},
+				MinConnectTimeout: rpcTimeout,
+			}))
+		if err != nil {
+			store.close()
+			return nil, err
+		}
+		n.peers[p] = pb.NewReplicaClient(conn)
+		n.kicks[p] = make(chan struct{}, 1)
+	}
+	return n, nil
+}
+
+// Start runs the election timer and the applier.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+	go n.tick()
+	go n.applier()
+}
+
+// Len is the number of entries in the log.
+func (n *Node) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.log) - 1
+}
+
+// Submit puts cmd in the log, through the leader if that is another
+// replica. it returns once the leader has it, not when it is committed:
+// the caller waits for apply. it tries again while there is no leader,
+// until ctx is done.
+func (n *Node) Submit(ctx context.Context, cmd *pb.Command) error {
+	return n.toLeader(ctx, "take the command",
+		func() error {
+			_, _, err := n.propose(cmd)
+			return err
+		},
+		func(c pb.ReplicaClient) error {
+			_, err := c.Propose(ctx, &pb.ProposeRequest{Command: cmd})
+			return err
+		})
+}
+
+// Barrier returns once this replica applied everything the leader had
+// committed when it was called, for a read that must not miss anything.
+// unlike a command, it adds nothing to the log.
+func (n *Node) Barrier(ctx context.Context) error {
+	var index uint64
+	err := n.toLeader(ctx, "read from",
+		func() error {
+			var err error
+			index, err = n.readIndex(ctx)
+			return err
+		},
+		func(c pb.ReplicaClient) error {
+			reply, err := c.ReadIndex(ctx, &pb.ReadIndexRequest{})
+			index = reply.GetIndex()
+			return err
+		})
+	if err != nil {
+		return err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		n.mu.Lock()
+		n.applied.Broadcast()
+		n.mu.Unlock()
+	})
+	defer stop()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.lastApplied < index {
+		if ctx.Err() != nil {
+			return status.Errorf(codes.Unavailable, "entry %d not applied yet: %v", index, ctx.Err())
+		}
+		n.applied.Wait()
+	}
+	return nil
+}
+
+// toLeader calls local if n is the leader, or remote with the leader we
+// know of. it tries again while there is no leader, until ctx is done;
+// what is for the error then.
+func (n *Node) toLeader(ctx context.Context, what string, local func() error, remote func(pb.ReplicaClient) error) error {
+	for {
+		n.mu.Lock()
+		isLeader, to := n.role == leader, n.leader
+		n.mu.Unlock()
+
+		var err error
+		switch {
+		case isLeader:
+			err = local()
+		case to != 0 && to != n.id:
+			err = remote(n.peers[to])
+		default:
+			err = status.Errorf(codes.Unavailable, "no leader")
+		}
+		switch status.Code(err) {
+		case codes.OK:
+			return nil
+		case codes.Unavailable, codes.FailedPrecondition, codes.DeadlineExceeded:
+			// no leader, or the one we knew isn't any more
+		default:
+			if !errors.Is(err, ErrNotLeader) {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return status.Errorf(codes.Unavailable, "no leader to %s: %v", what, err)
+		case <-time.After(heartbeat):
+		}
+	}
+}
+
+// Propose is Submit for a replica that isn't the leader. a replica only
+// proposes its own commands.
+func (n *Node) Propose(ctx context.Context, req *pb.ProposeRequest) (*pb.ProposeReply, error) {
+	cmd := req.GetCommand()
+	if cmd == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "no command")
+	}
+	if from := peerOf(ctx); cmd.GetReplica() != from {
+		return nil, status.Errorf(codes.PermissionDenied, "replica %d proposed a command of replica %d", from, cmd.GetReplica())
+	}
+	index, term, err := n.propose(cmd)
+	if errors.Is(err, ErrNotLeader) {
+		return nil, status.Errorf(codes.FailedPrecondition, "replica %d is not the leader", n.id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ProposeReply{Index: index, Term: term}, nil
+}
+
+// ReadIndex is Barrier for a replica that isn't the leader.
+func (n *Node) ReadIndex(ctx context.Context, req *pb.ReadIndexRequest) (*pb.ReadIndexReply, error) {
+	index, err := n.readIndex(ctx)
+	if errors.Is(err, ErrNotLeader) {
+		return nil, status.Errorf(codes.FailedPrecondition, "replica %d is not the leader", n.id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ReadIndexReply{Index: index}, nil
+}
+
+// readIndex is the leader's commit index, once a majority still takes
+// it as the leader: a leader that was voted out without hearing of it
+// may not have everything that is committed.
+func (n *Node) readIndex(ctx context.Context) (uint64, error) {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+	// a new leader only knows what is committed once its first entry is
+	if n.log[n.commit].GetTerm() != n.term {
+		n.mu.Unlock()
+		return 0, status.Errorf(codes.Unavailable, "replica %d has committed nothing of term %d yet", n.id, n.term)
+	}
+	index, term := n.commit, n.term
+	reqs := make(map[uint64]*pb.AppendRequest)
+	for p := range n.peers {
+		prev := n.next[p] - 1
+		reqs[p] = &pb.AppendRequest{Term: term, Leader: n.id, PrevIndex: prev, PrevTerm: n.log[prev].GetTerm(), Commit: n.commit}
+	}
+	n.mu.Unlock()
+
+	// a heartbeat to everyone. a follower that doesn't have the entries
+	// before still takes us as its leader.
+	acks := make(chan bool, len(reqs))
+	for p, req := range reqs {
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+			defer cancel()
+			reply, err := n.peers[p].AppendEntries(ctx, req)
+			if err == nil && reply.GetTerm() > term {
+				n.mu.Lock()
+				if reply.GetTerm() > n.term {
+					n.stepDown(reply.GetTerm())
+				}
+				n.mu.Unlock()
+			}
+			acks <- err == nil && reply.GetTerm() == term
+		}()
+	}
+	count := 1
+	for range reqs {
+		if n.majority(count) {
+			break
+		}
+		if <-acks {
+			count++
+		}
+	}
+	if !n.majority(count) {
+		return 0, status.Errorf(codes.Unavailable, "replica %d is not sure it is still the leader", n.id)
+	}
+	return index, nil
+}
+
+// propose appends cmd to the leader's log.
+func (n *Node) propose(cmd *pb.Command) (uint64, uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != leader {
+		return 0, 0, ErrNotLeader
+	}
+	e := &pb.Entry{Term: n.term, Index: uint64(len(n.log)), Command: cmd}
+	n.appendLocked(e)
+	n.advanceCommit()
+	n.kickAll()
+	return e.Index, e.Term, nil
+}
+
+// appendLocked writes entries to disk and to the log. a replica that
+// can't write can't promise anything, so it stops. must hold n.mu.
+func (n *Node) appendLocked(entries ...*pb.Entry) {
+	if err := n.store.append(entries); err != nil {
+		log.Fatalf("[RAFT] [STORAGE_FAILED] [%v]", err)
+	}
+	n.log = append(n.log, entries...)
+}
+
+// setTerm moves to a newer term, where we haven't voted. must hold n.mu.
+func (n *Node) setTerm(term uint64, vote uint64) {
+	n.term, n.votedFor = term, vote
+	if err := n.store.saveState(hardState{Term: term, Vote: vote}); err != nil {
+		log.Fatalf("[RAFT] [STORAGE_FAILED] [%v]", err)
+	}
+}
+
+// stepDown makes n a follower in term. must hold n.mu.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.setTerm(term, 0)
+		n.leader = 0
+	}
+	if n.role != follower {
+		log.Printf("[RAFT] [FOLLOWER replica=%d] [term=%d]", n.id, n.term)
+	}
+	n.role = follower
+}
+
+func (n *Node) resetDeadline() {
+	n.deadline = time.Now().Add(electionMin + rand.N(electionMax-electionMin))
+}
+
+func (n *Node) lastIndexTerm() (uint64, uint64) {
+	last := n.log[len(n.log)-1]
+	return last.GetIndex(), last.GetTerm()
+}
+
+// tick starts an election when the leader wasn't heard from in time.
+func (n *Node) tick() {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for range t.C {
+		n.mu.Lock()
+		if n.role != leader && time.Now().After(n.deadline) {
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// campaign asks the others for their votes in a new term. must hold n.mu.
+func (n *Node) campaign() {
+	n.setTerm(n.term+1, n.id)
+	n.role = candidate
+	n.leader = 0
+	n.resetDeadline()
+	term := n.term
+	lastIndex, lastTerm := n.lastIndexTerm()
+	log.Printf("[RAFT] [ELECTION replica=%d] [term=%d] [last=%d/%d]", n.id, term, lastIndex, lastTerm)
+
+	votes := 1
+	if n.majority(votes) {
+		n.becomeLeader()
+		return
+	}
+	req := &pb.VoteRequest{Term: term, Candidate: n.id, LastIndex: lastIndex, LastTerm: lastTerm}
+	for _, c := range n.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+			defer cancel()
+			reply, err := c.RequestVote(ctx, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			switch {
+			case reply.GetTerm() > n.term:
+				n.stepDown(reply.GetTerm())
+			case n.role == candidate && n.term == term && reply.GetGranted():
+				votes++
+				if n.majority(votes) {
+					n.becomeLeader()
+				}
+			}
+		}()
+	}
+}
+
+func (n *Node) majority(count int) bool {
+	return 2*count > len(n.peers)+1
+}
+
+// becomeLeader starts the new term with an empty entry: entries from
+// earlier terms only commit with one from the leader's own. must hold
+// n.mu.
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.id
+	log.Printf("[RAFT] [LEADER replica=%d] [term=%d]", n.id, n.term)
+	for p := range n.peers {
+		n.next[p] = uint64(len(n.log))
+		n.match[p] = 0
+	}
+	n.appendLocked(&pb.Entry{Term: n.term, Index: uint64(len(n.log))})
+	n.advanceCommit()
+	for p := range n.peers {
+		go n.replicate(p, n.term)
+	}
+}
+
+func (n *Node) kickAll() {
+	for _, k := range n.kicks {
+		select {
+		case k <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends the log to peer p while n is its leader in term: what
+// p doesn't have yet, or a heartbeat.
+func (n *Node) replicate(p, term uint64) {
+	for {
+		n.mu.Lock()
+		if n.role != leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		next := n.next[p]
+		end, size := next, 0
+		for end < uint64(len(n.log)) && end < next+maxBatch && (end == next || size < maxBytes) {
+			size += proto.Size(n.log[end])
+			end++
+		}
+		req := &pb.AppendRequest{
+			Term:      term,
+			Leader:    n.id,
+			PrevIndex: next - 1,
+			PrevTerm:  n.log[next-1].GetTerm(),
+			Entries:   append([]*pb.Entry(nil), n.log[next:end]...),
+			Commit:    n.commit,
+		}
+		n.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+		reply, err := n.peers[p].AppendEntries(ctx, req)
+		cancel()
+
+		more := false
+		if err == nil {
+			n.mu.Lock()
+			switch {
+			case reply.GetTerm() > n.term:
+				n.stepDown(reply.GetTerm())
+			case n.role != leader || n.term != term:
+			case reply.GetSuccess():
+				n.match[p] = max(n.match[p], end-1)
+				n.next[p] = n.match[p] + 1
+				n.advanceCommit()
+				more = n.next[p] < uint64(len(n.log))
+			default:
+				// back to where p's log may match ours
+				n.next[p] = max(1, min(next-1, reply.GetLastIndex()+1))
+				more = true
+			}
+			n.mu.Unlock()
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-n.kicks[p]:
+		case <-time.After(heartbeat):
+		}
+	}
+}
+
+// advanceCommit commits the last entry of this term that a majority has.
+// must hold n.mu.
+func (n *Node) advanceCommit() {
+	for i := uint64(len(n.log)) - 1; i > n.commit; i-- {
+		if n.log[i].GetTerm() != n.term {
+			break // older entries only commit along with this term's
+		}
+		count := 1
+		for _, m := range n.match {
+			if m >= i {
+				count++
+			}
+		}
+		if n.majority(count) {
+			n.commit = i
+			n.applied.Broadcast()
+			n.kickAll() // the followers learn it sooner
+			return
+		}
+	}
+}
+
+// applier hands the committed entries to apply, one at a time.
+func (n *Node) applier() {
+	var done uint64
+	for {
+		n.mu.Lock()
+		for done >= n.commit {
+			n.applied.Wait()
+		}
+		entries := n.log[done+1 : n.commit+1]
+		n.mu.Unlock()
+		for _, e := range entries {
+			n.apply(e)
+		}
+		done += uint64(len(entries))
+
+		n.mu.Lock()
+		n.lastApplied = done
+		n.applied.Broadcast()
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) RequestVote(ctx context.Context, req *pb.VoteRequest) (*pb.VoteReply, error) {
+	if from := peerOf(ctx); req.GetCandidate() != from {
+		return nil, status.Errorf(codes.PermissionDenied, "replica %d asked for votes for replica %d", from, req.GetCandidate())
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.GetTerm() > n.term {
+		n.stepDown(req.GetTerm())
+	}
+	lastIndex, lastTerm := n.lastIndexTerm()
+	// only for a candidate whose log has everything ours has
+	upToDate := req.GetLastTerm() > lastTerm || req.GetLastTerm() == lastTerm && req.GetLastIndex() >= lastIndex
+	granted := req.GetTerm() == n.term && (n.votedFor == 0 || n.votedFor == req.GetCandidate()) && upToDate
+	if granted {
+		n.setTerm(n.term, req.GetCandidate())
+		n.resetDeadline()
+	}
+	return &pb.VoteReply{Term: n.term, Granted: granted}, nil
+}
+
+func (n *Node) AppendEntries(ctx context.Context, req *pb.AppendRequest) (*pb.AppendReply, error) {
+	if from := peerOf(ctx); req.GetLeader() != from {
+		return nil, status.Errorf(codes.PermissionDenied, "replica %d sent entries as replica %d", from, req.GetLeader())
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	lastIndex, _ := n.lastIndexTerm()
+	if req.GetTerm() < n.term {
+		return &pb.AppendReply{Term: n.term, LastIndex: lastIndex}, nil
+	}
+	if req.GetTerm() > n.term || n.role != follower {
+		n.stepDown(req.GetTerm())
+	}
+	if n.leader != req.GetLeader() {
+		n.leader = req.GetLeader()
+		log.Printf("[RAFT] [FOLLOWING replica=%d] [leader=%d] [term=%d]", n.id, n.leader, n.term)
+	}
+	// from when the entries are on disk too: writing a big batch may take
+	// longer than the timeout, and the leader was there all along
+	defer n.resetDeadline()
+
+	prev := req.GetPrevIndex()
+	if prev > lastIndex {
+		return &pb.AppendReply{Term: n.term, LastIndex: lastIndex}, nil
+	}
+	if n.log[prev].GetTerm() != req.GetPrevTerm() {
+		return &pb.AppendReply{Term: n.term, LastIndex: prev - 1}, nil
+	}
+	for i, e := range req.GetEntries() {
+		at := prev + 1 + uint64(i)
+		if at < uint64(len(n.log)) {
+			if n.log[at].GetTerm() == e.GetTerm() {
+				continue // we have it already
+			}
+			// ours were never committed, the leader's win
+			n.log = n.log[:at]
+			if err := n.store.rewrite(n.log); err != nil {
+				log.Fatalf("[RAFT] [STORAGE_FAILED] [%v]", err)
+			}
+		}
+		n.appendLocked(req.GetEntries()[i:]...)
+		break
+	}
+	if last := prev + uint64(len(req.GetEntries())); req.GetCommit() > n.commit && last > n.commit {
+		n.commit = min(req.GetCommit(), last)
+		n.applied.Broadcast()
+	}
+	return &pb.AppendReply{Term: n.term, Success: true, LastIndex: uint64(len(n.log)) - 1}, nil
+}
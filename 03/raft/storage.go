@@ -0,0 +1,167 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// storage is what a replica must not forget across a restart: its term,
+// its vote in it, and the log. the log is one json entry per line, the
+// rest one small json file that is replaced as a whole.
+type storage struct {
+	dir string
+	f   *os.File // the log, for appending
+}
+
+type hardState struct {
+	Term uint64 `json:"term"`
+	Vote uint64 `json:"vote"`
+}
+
+// openStorage reads back what is in dir, or starts it.
+func openStorage(dir string) (*storage, hardState, []*pb.Entry, error) {
+	var hs hardState
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, hs, nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, hs, nil, err
+	default:
+		if err := json.Unmarshal(b, &hs); err != nil {
+			return nil, hs, nil, fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+
+	path := filepath.Join(dir, "raft.log")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, hs, nil, err
+	}
+	entries := []*pb.Entry{{}} // entries[0] is before the first entry
+	var bad error
+	badLine := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		if bad != nil {
+			// not the last line, so not a write cut off by a crash: the
+			// entries after it were acked, and may be committed
+			f.Close()
+			return nil, hs, nil, fmt.Errorf("%s: line %d: %v", path, badLine, bad)
+		}
+		e := &pb.Entry{}
+		if err := protojson.Unmarshal(sc.Bytes(), e); err != nil {
+			bad, badLine = err, n
+			continue
+		}
+		if e.GetIndex() != uint64(len(entries)) {
+			f.Close()
+			return nil, hs, nil, fmt.Errorf("%s: entry %d where %d should be", path, e.GetIndex(), len(entries))
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, hs, nil, err
+	}
+	s := &storage{dir: dir, f: f}
+	if bad != nil {
+		// the last line, cut off by a crash: it was never acked
+		log.Printf("[RAFT] [TORN_ENTRY line=%d] [%v]", badLine, bad)
+		if err := s.rewrite(entries); err != nil {
+			return nil, hs, nil, err
+		}
+	}
+	return s, hs, entries, nil
+}
+
+func (s *storage) saveState(hs hardState) error {
+	b, err := json.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(s.dir, "state.json"), b)
+}
+
+// append writes entries after the others, and only returns once they
+// are on disk.
+func (s *storage) append(entries []*pb.Entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		b, err := protojson.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	if _, err := s.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// rewrite replaces the log on disk with log, for when a follower's
+// entries conflict with the leader's.
+func (s *storage) rewrite(log []*pb.Entry) error {
+	var buf bytes.Buffer
+	for _, e := range log[1:] {
+		b, err := protojson.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	path := s.f.Name()
+	if err := writeFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = f
+	return nil
+}
+
+func (s *storage) close() error {
+	return s.f.Close()
+}
+
+// writeFile writes a new file and renames it over the old one, so a crash
+// leaves one or the other.
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
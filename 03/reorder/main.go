@@ -0,0 +1,137 @@
+// Command reorder checks the client's holdback queue. it simulates a
+// chat where every copy of a message takes a random time to arrive, so
+// replies often overtake what they answer, and checks that what comes
+// out of a causal.Holdback is in causal order anyway.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"chitchat/causal"
+	pb "chitchat/grpc"
+	"chitchat/vclock"
+)
+
+// a copy of an event on its way to a participant, the observer is 0
+type arrival struct {
+	at int
+	to uint64
+	ev *pb.Event
+}
+
+// participant is a chat client of the simulation. it only sees what its
+// holdback delivered, and sends with that clock like the real client.
+type participant struct {
+	id uint64
+	hb *causal.Holdback
+	vc vclock.Clock
+}
+
+func main() {
+	n := flag.Int("n", 3, "participants")
+	msgs := flag.Int("msgs", 200, "messages to send")
+	maxDelay := flag.Int("delay", 50, "max ticks a copy takes, the order is random below that")
+	loss := flag.Float64("loss", 0, "chance a copy to the observer is lost, 0 to 1")
+	holdFor := flag.Int("holdback", 200, "ticks the observer waits for a lost event")
+	seed := flag.Int64("seed", 1, "random seed")
+	flag.Parse()
+
+	rng := rand.New(rand.NewSource(*seed))
+	base := time.Unix(0, 0)
+	tick := func(t int) time.Time { return base.Add(time.Duration(t) * time.Millisecond) }
+
+	ps := make([]*participant, *n)
+	for i := range ps {
+		ps[i] = &participant{id: uint64(i + 1), hb: causal.NewHoldback(nil), vc: make(vclock.Clock)}
+	}
+	observer := causal.NewHoldback(nil)
+
+	var pending []arrival
+	var arrived, delivered []*pb.Event
+	var lost, held int
+	lamport := uint64(0)
+
+	send := func(t int, ev *pb.Event) {
+		for _, p := range ps {
+			pending = append(pending, arrival{t + 1 + rng.Intn(*maxDelay), p.id, ev})
+		}
+		if rng.Float64() < *loss {
+			lost++
+			return
+		}
+		pending = append(pending, arrival{t + 1 + rng.Intn(*maxDelay), 0, ev})
+	}
+
+	for t, sent := 0, 0; sent < *msgs || len(pending) > 0 || observer.Len() > 0; t++ {
+		// a random participant answers what it has seen so far
+		if sent < *msgs && rng.Intn(2) == 0 {
+			p := ps[rng.Intn(len(ps))]
+			p.vc[p.id]++
+			lamport++
+			sent++
+			send(t, &pb.Event{
+				Type:        pb.EventType_EVENT_USER_MSG,
+				ClientId:    p.id,
+				Text:        fmt.Sprintf("message %d", sent),
+				Lamport:     lamport,
+				VectorClock: p.vc.Copy(),
+			})
+		}
+
+		sort.SliceStable(pending, func(i, j int) bool { return pending[i].at < pending[j].at })
+		for len(pending) > 0 && pending[0].at <= t {
+			a := pending[0]
+			pending = pending[1:]
+			if a.to != 0 {
+				p := ps[a.to-1]
+				for _, ev := range p.hb.Add(a.ev, tick(t)) {
+					p.vc.Merge(ev.GetVectorClock())
+				}
+				continue
+			}
+			arrived = append(arrived, a.ev)
+			delivered = append(delivered, observer.Add(a.ev, tick(t))...)
+			held = max(held, observer.Len())
+		}
+		delivered = append(delivered, observer.Expire(tick(t), time.Duration(*holdFor)*time.Millisecond)...)
+	}
+
+	log.Printf("[REORDER] [participants=%d msgs=%d delay=0-%d loss=%.2f seed=%d]", *n, *msgs, *maxDelay, *loss, *seed)
+	log.Printf("[REORDER] [arrival_order] [out_of_order=%d of %d]", outOfOrder(arrived), len(arrived))
+	bad := outOfOrder(delivered)
+	log.Printf("[REORDER] [holdback] [out_of_order=%d of %d] [lost=%d] [max_held=%d]", bad, len(delivered), lost, held)
+
+	switch {
+	case len(delivered) != len(arrived):
+		log.Printf("[REORDER] [FAIL] [delivered %d of %d arrived]", len(delivered), len(arrived))
+		os.Exit(1)
+	case bad > 0 && lost == 0:
+		log.Printf("[REORDER] [FAIL] [%d delivered before an event they depend on]", bad)
+		os.Exit(1)
+	}
+	log.Printf("[REORDER] [PASS]")
+}
+
+// outOfOrder counts the events that come before one they depend on: one
+// of their sender's earlier messages, or a message the sender had seen.
+func outOfOrder(evs []*pb.Event) int {
+	seen := make(vclock.Clock)
+	bad := 0
+	for _, ev := range evs {
+		from := ev.GetClientId()
+		for id, n := range ev.GetVectorClock() {
+			if id == from && n != seen[id]+1 || id != from && n > seen[id] {
+				bad++
+				break
+			}
+		}
+		seen.Merge(ev.GetVectorClock())
+	}
+	return bad
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minPassword = 6
+	hashRounds  = 100_000 // pbkdf2 iterations
+)
+
+// user is a registered account. the password is only kept as a salted
+// pbkdf2 hash, the login token as its sha-256.
+type user struct {
+	name      string
+	salt      []byte
+	hash      []byte
+	tokenHash []byte
+}
+
+// session is one Login. the participant ids its Joins handed out are
+// its own, nobody else may use them.
+type session struct {
+	user string
+	hash []byte // sha-256 of the token
+	ids  map[uint64]bool
+}
+
+// auth keeps the users and the sessions. they are replicated: Register
+// and Login are commands, so they are in the replicated log, and a
+// session works on every replica.
+type auth struct {
+	mu       sync.Mutex
+	users    map[string]*user
+	sessions map[string]*session // by the token's sha-256
+
+	// catchUp waits until this replica applied everything committed, for
+	// a user or session it doesn't know yet but another replica may
+	catchUp func(context.Context) error
+}
+
+func newAuth() *auth {
+	return &auth{
+		users:    make(map[string]*user),
+		sessions: make(map[string]*session),
+	}
+}
+
+func (s *server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterReply, error) {
+	name := req.GetUsername()
+	if err := checkUsername(name); err != nil {
+		return nil, err
+	}
+	if len(req.GetPassword()) < minPassword {
+		return nil, status.Errorf(codes.InvalidArgument, "password shorter than %d", minPassword)
+	}
+	salt := randomBytes(16)
+	token := hex.EncodeToString(randomBytes(16))
+	sum := sha256.Sum256([]byte(token))
+	_, err := propose[any](ctx, s, &pb.Command{Op: &pb.Command_Register{Register: &pb.RegisterCommand{
+		Username:  name,
+		Salt:      salt,
+		Hash:      pbkdf2(req.GetPassword(), salt),
+		TokenHash: sum[:],
+	}}})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RegisterReply{LoginToken: token}, nil
+}
+
+func (s *server) applyRegister(c *pb.RegisterCommand) error {
+	a := s.auth
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.users[c.GetUsername()] != nil {
+		return status.Errorf(codes.AlreadyExists, "user %s exists", c.GetUsername())
+	}
+	a.users[c.GetUsername()] = &user{name: c.GetUsername(), salt: c.GetSalt(), hash: c.GetHash(), tokenHash: c.GetTokenHash()}
+	log.Printf("[CLIENT] [REGISTER_RPC user=%s]", c.GetUsername())
+	return nil
+}
+
+func (s *server) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginReply, error) {
+	a := s.auth
+	u := a.user(req.GetUsername())
+	if u == nil {
+		if err := a.catchUp(ctx); err != nil {
+			return nil, err
+		}
+		u = a.user(req.GetUsername())
+	}
+
+	// the same answer for a wrong name and a wrong secret
+	denied := status.Errorf(codes.Unauthenticated, "wrong username, password or token")
+	if u == nil {
+		return nil, denied
+	}
+	var ok bool
+	switch secret := req.GetSecret().(type) {
+	case *pb.LoginRequest_Password:
+		ok = hmac.Equal(pbkdf2(secret.Password, u.salt), u.hash)
+	case *pb.LoginRequest_LoginToken:
+		sum := sha256.Sum256([]byte(secret.LoginToken))
+		ok = subtle.ConstantTimeCompare(sum[:], u.tokenHash) == 1
+	}
+	if !ok {
+		log.Printf("[CLIENT] [LOGIN_DENIED user=%s]", req.GetUsername())
+		return nil, denied
+	}
+
+	token := hex.EncodeToString(randomBytes(16))
+	sum := sha256.Sum256([]byte(token))
+	_, err := propose[any](ctx, s, &pb.Command{Op: &pb.Command_Login{Login: &pb.LoginCommand{
+		Username:    u.name,
+		SessionHash: sum[:],
+	}}})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LoginReply{SessionToken: token}, nil
+}
+
+func (s *server) applyLogin(c *pb.LoginCommand) {
+	a := s.auth
+	a.mu.Lock()
+	a.sessions[string(c.GetSessionHash())] = &session{user: c.GetUsername(), hash: c.GetSessionHash(), ids: make(map[uint64]bool)}
+	a.mu.Unlock()
+	log.Printf("[CLIENT] [LOGIN_RPC user=%s]", c.GetUsername())
+}
+
+func (a *auth) user(name string) *user {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.users[name]
+}
+
+func (a *auth) sessionByHash(hash []byte) *session {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sessions[string(hash)]
+}
+
+// bind gives participant id to the session that joined with it.
+func (a *auth) bind(sess *session, id uint64) {
+	a.mu.Lock()
+	sess.ids[id] = true
+	a.mu.Unlock()
+}
+
+// session finds the session of the bearer token in ctx's metadata. a
+// token from a Login on another replica may not be here yet.
+func (a *auth) session(ctx context.Context) (*session, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var hashes [][]byte
+	for _, v := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(v, "Bearer "); ok {
+			sum := sha256.Sum256([]byte(token))
+			hashes = append(hashes, sum[:])
+		}
+	}
+	for try := 0; try < 2 && len(hashes) > 0; try++ {
+		if try > 0 {
+			if err := a.catchUp(ctx); err != nil {
+				return nil, err
+			}
+		}
+		for _, h := range hashes {
+			if sess := a.sessionByHash(h); sess != nil {
+				return sess, nil
+			}
+		}
+	}
+	return nil, status.Errorf(codes.Unauthenticated, "no valid session token, Login first")
+}
+
+func (a *auth) owns(sess *session, id uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return sess.ids[id]
+}
+
+// check says if sess may act for the participant req names, if it names
+// one. Join hands out new ids, its request has none.
+func (a *auth) check(ctx context.Context, sess *session, method string, req any) error {
+	r, ok := req.(interface{ GetClientId() uint64 })
+	if !ok {
+		return nil
+	}
+	id := r.GetClientId()
+	mine := a.owns(sess, id)
+	if !mine {
+		// the Join may have been on another replica
+		if err := a.catchUp(ctx); err != nil {
+			return err
+		}
+		mine = a.owns(sess, id)
+	}
+	if !mine {
+		log.Printf("[SERVER] [IMPERSONATION_DENIED user=%s] [client=%d] [method=%s]", sess.user, id, method)
+		return status.Errorf(codes.PermissionDenied, "participant %d is not %s's", id, sess.user)
+	}
+	return nil
+}
+
+// public are the methods that need no session.
+var public = map[string]bool{
+	pb.Echo_Register_FullMethodName: true,
+	pb.Echo_Login_FullMethodName:    true,
+}
+
+type sessionKey struct{}
+
+// sessionOf is the session the interceptors put in ctx.
+func sessionOf(ctx context.Context) *session {
+	sess, _ := ctx.Value(sessionKey{}).(*session)
+	return sess
+}
+
+// unaryAuth checks the session and the participant id of every call
+// but Register and Login.
+func (a *auth) unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if public[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	sess, err := a.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.check(ctx, sess, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, sessionKey{}, sess), req)
+}
+
+// streamAuth does the same for Subscribe, whose request comes through
+// RecvMsg.
+func (a *auth) streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	sess, err := a.session(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authStream{ss, a, sess, info.FullMethod})
+}
+
+type authStream struct {
+	grpc.ServerStream
+	a      *auth
+	sess   *session
+	method string
+}
+
+func (s *authStream) Context() context.Context {
+	return context.WithValue(s.ServerStream.Context(), sessionKey{}, s.sess)
+}
+
+func (s *authStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.a.check(s.ServerStream.Context(), s.sess, s.method, m)
+}
+
+func checkUsername(name string) error {
+	if name == "" || len(name) > 32 {
+		return status.Errorf(codes.InvalidArgument, "username must be 1 to 32 long")
+	}
+	if !nameChars(name) {
+		return status.Errorf(codes.InvalidArgument, "username %q: only letters, digits, '-' and '_'", name)
+	}
+	return nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported systems
+	}
+	return b
+}
+
+// pbkdf2 is PBKDF2-HMAC-SHA256 (rfc 8018) with one output block, which
+// is all a password hash needs. the standard library only has it from
+// go 1.24 on.
+func pbkdf2(password string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < hashRounds; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// what happens to a subscriber with more than maxLag events unacked
+const (
+	lagDisconnect = "disconnect" // end its stream, it can join again with since_lamport
+	lagDrop       = "drop"       // skip what it hasn't been sent yet, and tell it
+)
+
+// errLeft ends the stream of a participant that called Leave.
+var errLeft = errors.New("left")
+
+// errResumed ends a stream that another one resumed, here or on another
+// replica.
+var errResumed = errors.New("resumed")
+
+// sendBatch is how many events a sender takes from the log at a time.
+const sendBatch = 64
+
+// subscriber is what a participant's Subscribe stream reads. instead of
+// a queue it has a cursor into the event log, so a slow one is caught up
+// from the log and nothing is lost on the way. it outlives a stream that
+// broke, for a resumed one to go on from there.
+type subscriber struct {
+	id      uint64
+	cursor  int           // the next log position to look at
+	acked   int           // the events before this position were acked
+	dropped int           // events skipped by the drop policy, for the notice
+	err     error         // ends the stream, from Leave or the disconnect policy
+	wake    chan struct{} // poked when the log grows or err is set
+	gen     int           // counts the streams, a resume ends the one before
+	epoch   uint64        // of the attachment in the replicated log
+	grace   *time.Timer   // while the stream is broken: the leave after it
+
+	recovered bool // from the log after a restart, there was no stream yet
+}
+
+func newSubscriber(id uint64, head int) *subscriber {
+	return &subscriber{id: id, cursor: head, acked: head, wake: make(chan struct{}, 1)}
+}
+
+func (sub *subscriber) poke() {
+	select {
+	case sub.wake <- struct{}{}:
+	default: // already poked
+	}
+}
+
+// next waits for the next events for stream gen of sub, and moves its
+// cursor past them. it returns the error that ends the stream instead,
+// if there is one.
+func (s *server) next(ctx context.Context, sub *subscriber, gen int) ([]*pb.Event, error) {
+	for {
+		s.mu.Lock()
+		if sub.err != nil {
+			s.mu.Unlock()
+			return nil, sub.err
+		}
+		if sub.gen != gen {
+			s.mu.Unlock()
+			return nil, errResumed
+		}
+		var out []*pb.Event
+		if sub.dropped > 0 {
+			out = append(out, &pb.Event{
+				Type: pb.EventType_EVENT_DROPPED,
+				Text: fmt.Sprintf("%d events dropped, you fell too far behind", sub.dropped),
+			})
+			sub.dropped = 0
+		}
+		events := s.history.events
+		for ; sub.cursor < len(events) && len(out) < sendBatch; sub.cursor++ {
+			if s.wants(sub, sub.cursor) {
+				out = append(out, events[sub.cursor])
+			}
+		}
+		s.mu.Unlock()
+		if len(out) > 0 {
+			return out, nil
+		}
+
+		select {
+		case <-sub.wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// wants says if the event at pos in the log is for sub: from a room it
+// was in when the event was logged. must hold s.mu.
+func (s *server) wants(sub *subscriber, pos int) bool {
+	name, _ := roomName(s.history.events[pos].GetRoom())
+	r := s.rooms[name]
+	if r == nil {
+		return false
+	}
+	joined, ok := r.members[sub.id]
+	return ok && pos >= joined
+}
+
+// unacked counts the events for sub after the last one it acked, sent or
+// not. must hold s.mu.
+func (s *server) unacked(sub *subscriber) int {
+	n := 0
+	for pos := sub.acked; pos < len(s.history.events); pos++ {
+		if s.wants(sub, pos) {
+			n++
+		}
+	}
+	return n
+}
+
+// checkLag applies the lag policy to sub if it is too far behind. the
+// disconnect policy only works once the sender is back from the stream:
+// a Send to a client that doesn't read at all blocks until the
+// transport gives up. must hold s.mu.
+func (s *server) checkLag(sub *subscriber) {
+	head := len(s.history.events)
+	if s.maxLag <= 0 || sub.err != nil || sub.recovered || head-sub.acked <= s.maxLag {
+		return // the last check can't be over, it counts fewer
+	}
+	n := s.unacked(sub)
+	if n <= s.maxLag {
+		return
+	}
+	switch s.lagPolicy {
+	case lagDrop:
+		skipped := 0
+		for pos := sub.cursor; pos < head; pos++ {
+			if s.wants(sub, pos) {
+				skipped++
+			}
+		}
+		sub.dropped += skipped
+		sub.cursor, sub.acked = head, head
+		log.Printf("[SERVER] [LAG_DROPPED client=%d] [unacked=%d] [dropped=%d]", sub.id, n, skipped)
+	default:
+		sub.err = status.Errorf(codes.ResourceExhausted, "%d events unacked, more than %d", n, s.maxLag)
+		log.Printf("[SERVER] [LAG_DISCONNECT client=%d] [unacked=%d]", sub.id, n)
+	}
+	sub.poke()
+}
+
+// Ack moves the subscriber's acked position past the event it names.
+// the stream is in log order, so that covers every event before it.
+func (s *server) Ack(ctx context.Context, req *pb.AckRequest) (*pb.AckReply, error) {
+	name, err := roomName(req.GetRoom())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := s.clients[req.GetClientId()]
+	if sub == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "participant %d is not subscribed", req.GetClientId())
+	}
+	pos, ok := s.history.pos(name, req.GetLamport())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no event at L=%d in #%s", req.GetLamport(), name)
+	}
+	// never past what was sent
+	sub.acked = max(sub.acked, min(pos+1, sub.cursor))
+	n := s.unacked(sub)
+	log.Printf("[CLIENT] [ACK_RPC client=%d] [room=%s L=%d] [unacked=%d]", sub.id, name, req.GetLamport(), n)
+	return &pb.AckReply{Unacked: uint64(n)}, nil
+}
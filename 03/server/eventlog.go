@@ -0,0 +1,57 @@
+package main
+
+import (
+	pb "chitchat/grpc"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// eventLog is the history: every event in the order it was logged.
+// subscribers are sent their events from here, and replays come from
+// it. it isn't kept on disk, the replicated log is: applying that again
+// at startup makes the same events.
+type eventLog struct {
+	events []*pb.Event
+	index  map[logKey]int // position of each event in events
+}
+
+// logKey names an event: lamport times are per room.
+type logKey struct {
+	room    string
+	lamport uint64
+}
+
+func keyOf(ev *pb.Event) logKey {
+	name, _ := roomName(ev.GetRoom())
+	return logKey{name, ev.GetLamport()}
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{index: make(map[logKey]int)}
+}
+
+func (l *eventLog) append(ev *pb.Event) {
+	l.index[keyOf(ev)] = len(l.events)
+	l.events = append(l.events, ev)
+}
+
+// pos is where the event of room at lamport is in events.
+func (l *eventLog) pos(room string, lamport uint64) (int, bool) {
+	i, ok := l.index[logKey{room, lamport}]
+	return i, ok
+}
+
+// since returns copies of the room's events after lamport, marked as
+// replayed. the commands are applied one at a time, so in a room the log
+// is in lamport order.
+func (l *eventLog) since(room string, lamport uint64) []*pb.Event {
+	var out []*pb.Event
+	for _, ev := range l.events {
+		if name, _ := roomName(ev.GetRoom()); name == room && ev.GetLamport() > lamport {
+			ev = proto.Clone(ev).(*pb.Event)
+			ev.Replayed = true
+			out = append(out, ev)
+		}
+	}
+	return out
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// before the replicated log, the server kept its events in chitchat.log,
+// one json event per line, and its users in chitchat.users. a replica
+// that starts with an empty log imports them, and renames them so they
+// are only imported once.
+
+// importPartSize is about how many bytes of users and events go in one
+// command, so an entry stays well below what grpc and the log take.
+const importPartSize = 64 << 10
+
+// oldUser is a user as the users file has it.
+type oldUser struct {
+	Name      string `json:"name"`
+	Salt      []byte `json:"salt"`
+	Hash      []byte `json:"hash"`
+	TokenHash []byte `json:"token_hash"`
+}
+
+// readOld reads the old files. found is false when there are none.
+func readOld(logPath, usersPath string) (parts []*pb.ImportCommand, found bool, err error) {
+	sum := sha256.New()
+	var users []*pb.RegisterCommand
+	b, err := os.ReadFile(usersPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, false, err
+	default:
+		found = true
+		sum.Write(b)
+		var old []*oldUser
+		if err := json.Unmarshal(b, &old); err != nil {
+			return nil, false, fmt.Errorf("%s: %v", usersPath, err)
+		}
+		for _, u := range old {
+			users = append(users, &pb.RegisterCommand{Username: u.Name, Salt: u.Salt, Hash: u.Hash, TokenHash: u.TokenHash})
+		}
+	}
+
+	var events []*pb.Event
+	b, err = os.ReadFile(logPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, false, err
+	default:
+		found = true
+		sum.Write(b)
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		sc.Buffer(nil, 1<<20)
+		for n := 1; sc.Scan(); n++ {
+			ev := &pb.Event{}
+			if err := protojson.Unmarshal(sc.Bytes(), ev); err != nil {
+				// the old server skipped these too
+				log.Printf("[SERVER] [LOG_SKIPPED line=%d] [%v]", n, err)
+				continue
+			}
+			events = append(events, ev)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, false, fmt.Errorf("%s: %v", logPath, err)
+		}
+	}
+	if !found {
+		return nil, false, nil
+	}
+	// the old log is in broadcast order, a room's events must be in
+	// lamport order now
+	sort.SliceStable(events, func(i, j int) bool { return events[i].GetLamport() < events[j].GetLamport() })
+
+	part := &pb.ImportCommand{Sum: sum.Sum(nil)}
+	size := 0
+	next := func(n int) {
+		if size+n > importPartSize && size > 0 {
+			parts = append(parts, part)
+			part = &pb.ImportCommand{Part: part.GetPart() + 1, Sum: part.GetSum()}
+			size = 0
+		}
+		size += n
+	}
+	for _, u := range users {
+		next(proto.Size(u))
+		part.Users = append(part.Users, u)
+	}
+	for _, ev := range events {
+		next(proto.Size(ev))
+		part.Events = append(part.Events, ev)
+	}
+	return append(parts, part), true, nil
+}
+
+// importOld puts the old files in the replicated log, once a leader
+// takes them, and renames them to .imported.
+func (s *server) importOld(logPath, usersPath string) error {
+	parts, found, err := readOld(logPath, usersPath)
+	if err != nil || !found {
+		return err
+	}
+	if s.recovered > 0 {
+		return fmt.Errorf("%s or %s is from an older version, and the replicated log has entries already: start with an empty -data to import them, or move them away", logPath, usersPath)
+	}
+	users, events := 0, 0
+	for _, part := range parts {
+		cmd := &pb.Command{Op: &pb.Command_ImportFiles{ImportFiles: part}}
+		for {
+			// the same command again if it timed out: it is applied once
+			_, err := propose[any](context.Background(), s, cmd)
+			if err == nil {
+				break
+			}
+			if status.Code(err) != codes.Unavailable {
+				return err
+			}
+			log.Printf("[SERVER] [IMPORT_WAITING part=%d] [%v]", part.GetPart(), err)
+		}
+		users += len(part.GetUsers())
+		events += len(part.GetEvents())
+	}
+	for _, path := range []string{logPath, usersPath} {
+		// another replica in the same directory may have been first
+		if err := os.Rename(path, path+".imported"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	log.Printf("[SERVER] [IMPORTED] [log=%s events=%d] [users=%s registered=%d] [parts=%d]", logPath, events, usersPath, users, len(parts))
+	return nil
+}
+
+// applyImport only takes part 0 into an empty chat, and the others in
+// order after it. the parts of the same files proposed again, by this
+// replica or another one, are left out.
+func (s *server) applyImport(c *pb.ImportCommand) error {
+	a := s.auth
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if s.importSum != nil && bytes.Equal(c.GetSum(), s.importSum) && c.GetPart() < s.importPart {
+		return nil // imported already
+	}
+	switch {
+	case c.GetPart() == 0 && (len(a.users) > 0 || len(s.history.events) > 0 || s.nextID > 1):
+		return status.Errorf(codes.FailedPrecondition, "the chat isn't empty, nothing is imported into it")
+	case c.GetPart() != 0 && (c.GetPart() != s.importPart || !bytes.Equal(c.GetSum(), s.importSum)):
+		return status.Errorf(codes.FailedPrecondition, "import part %d out of order", c.GetPart())
+	}
+	s.importSum, s.importPart = c.GetSum(), c.GetPart()+1
+
+	for _, u := range c.GetUsers() {
+		a.users[u.GetUsername()] = &user{name: u.GetUsername(), salt: u.GetSalt(), hash: u.GetHash(), tokenHash: u.GetTokenHash()}
+	}
+	// the rooms, their clocks and the next id come back from the events,
+	// like the old server did at startup
+	for _, ev := range c.GetEvents() {
+		name, _ := roomName(ev.GetRoom())
+		r := s.rooms[name]
+		if r == nil {
+			r = newRoom(name)
+			s.rooms[name] = r
+		}
+		r.clock = max(r.clock, ev.GetLamport())
+		r.vclock.Merge(ev.GetVectorClock())
+		s.nextID = max(s.nextID, ev.GetClientId()+1)
+		if ev.GetUser() != "" {
+			s.names[ev.GetClientId()] = ev.GetUser()
+		}
+		s.history.append(ev)
+	}
+	log.Printf("[SERVER] [IMPORT part=%d] [users=%d events=%d]", c.GetPart(), len(c.GetUsers()), len(c.GetEvents()))
+	return nil
+}
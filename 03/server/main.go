@@ -2,170 +2,405 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	pb "chitchat/grpc"
+	"chitchat/raft"
+	"chitchat/vclock"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
 	pb.UnimplementedEchoServer
 
-	mu      sync.Mutex
-	clients map[uint64]chan *pb.Event
-	clock   uint64
-	nextID  uint64
+	id   uint64 // of this replica
+	node *raft.Node
+
+	// the replicated state, only changed by apply
+	mu           sync.Mutex
+	rooms        map[string]*room
+	nextID       uint64
+	names        map[uint64]string // the user of each participant
+	history      *eventLog
+	auth         *auth
+	resumeTokens map[uint64]string // from Join, to resume a broken stream
+	attached     map[uint64]uint64 // the epoch of each participant's stream
+	applied      map[string]result // by command id: a command in the log twice only counts once
+	importSum    []byte            // of the files imported from an older version
+	importPart   uint32            // the next part of them
+
+	// the replica's own
+	clients map[uint64]*subscriber
+	waiting map[string]chan result // by command id
+
+	recovered uint64 // the log entries from before a restart
+
+	maxLag    int    // unacked events a subscriber may have, 0 for any
+	lagPolicy string // lagDisconnect or lagDrop
+
+	resumeGrace time.Duration // how long a broken stream may be resumed
 }
 
-func newServer() *server {
+// newServer starts with nothing. applying the replicated log brings back
+// the rooms, their clocks, the users and the events.
+func newServer(id uint64, a *auth) *server {
 	return &server{
-		clients: make(map[uint64]chan *pb.Event),
-		clock:   0,
-		nextID:  1,
+		id:           id,
+		rooms:        map[string]*room{generalRoom: newRoom(generalRoom)},
+		nextID:       1,
+		names:        make(map[uint64]string),
+		history:      newEventLog(),
+		auth:         a,
+		resumeTokens: make(map[uint64]string),
+		attached:     make(map[uint64]uint64),
+		applied:      make(map[string]result),
+		clients:      make(map[uint64]*subscriber),
+		waiting:      make(map[string]chan result),
 	}
 }
 
-func (s *server) tick(c uint64) uint64 {
+// tick advances the room's lamport clock past c and merges vc into its
+// vector clock. a join or leave is an event of the participant that the
+// server counts for it, bump is its id (0 for none). it returns the new
+// lamport time and a copy of the vector clock.
+func (s *server) tick(r *room, c uint64, vc vclock.Clock, bump uint64) (uint64, vclock.Clock) {
 	s.mu.Lock()
-	if c > s.clock {
-		s.clock = c
+	if c > r.clock {
+		r.clock = c
+	}
+	r.clock++
+	lamport := r.clock
+	r.vclock.Merge(vc)
+	if bump != 0 {
+		r.vclock[bump]++
 	}
-	s.clock++
-	lamport := s.clock
+	out := r.vclock.Copy()
 	s.mu.Unlock()
-	return lamport
+	return lamport, out
 }
 
-func (s *server) broadcast(ev *pb.Event) {
+// nameOf is how events call participant id: by its user, or by number
+// for the ones from before users.
+func (s *server) nameOf(id uint64) string {
 	s.mu.Lock()
-	for id, ch := range s.clients {
-		select {
-		case ch <- ev:
-			log.Printf("[SERVER] [L=%d] [DELIVER to client=%d]", ev.GetLamport(), id)
-		default: // for non blocking
-			log.Printf("[SERVER] [L=%d] [DELIVER_SKIPPED to client=%d]", ev.GetLamport(), id)
-		}
+	defer s.mu.Unlock()
+	if name := s.names[id]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("Participant %d", id)
+}
+
+// broadcast logs ev as an event of r. the subscribers' senders take it
+// from the log.
+func (s *server) broadcast(r *room, ev *pb.Event) {
+	ev.Room = r.name
+	s.mu.Lock()
+	ev.User = s.names[ev.GetClientId()]
+	s.history.append(ev)
+	for _, sub := range s.clients {
+		s.checkLag(sub)
+		sub.poke()
 	}
 	s.mu.Unlock()
 }
 
 func (s *server) Join(ctx context.Context, req *pb.JoinRequest) (*pb.JoinReply, error) {
+	return propose[*pb.JoinReply](ctx, s, &pb.Command{Op: &pb.Command_Join{Join: &pb.JoinCommand{
+		SessionHash: sessionOf(ctx).hash,
+		Clock:       req.GetClock(),
+		ResumeToken: hex.EncodeToString(randomBytes(16)),
+	}}})
+}
+
+func (s *server) applyJoin(c *pb.JoinCommand) (*pb.JoinReply, error) {
+	sess := s.auth.sessionByHash(c.GetSessionHash())
+	if sess == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "no such session")
+	}
 	s.mu.Lock()
 	id := s.nextID
 	s.nextID = s.nextID + 1
+	s.names[id] = sess.user
+	general := s.rooms[generalRoom]
+	general.members[id] = len(s.history.events)
+	s.resumeTokens[id] = c.GetResumeToken()
 	s.mu.Unlock()
+	s.auth.bind(sess, id)
 
-	clock := s.tick(req.GetClock())
-	log.Printf("[CLIENT] [L=%d] [JOIN_RPC client=%d] [in=%d]", clock, id, req.GetClock())
-	return &pb.JoinReply{ClientId: id, ServerClock: clock}, nil
+	clock, vc := s.tick(general, c.GetClock(), nil, id)
+	log.Printf("[CLIENT] [L=%d] [JOIN_RPC client=%d] [user=%s] [in=%d] [VC=%v]", clock, id, sess.user, c.GetClock(), vc)
+	return &pb.JoinReply{ClientId: id, ServerClock: clock, VectorClock: vc, ResumeToken: c.GetResumeToken()}, nil
 }
 
 func (s *server) Leave(ctx context.Context, req *pb.LeaveRequest) (*pb.LeaveReply, error) {
-	id := req.ClientId
+	return propose[*pb.LeaveReply](ctx, s, &pb.Command{Op: &pb.Command_Leave{Leave: req}})
+}
 
-	ch, ok := s.clients[id]
-	if ok {
-		removeClient(s, id, ch)
-	}
+func (s *server) applyLeave(req *pb.LeaveRequest) *pb.LeaveReply {
+	id := req.GetClientId()
 
-	clock := s.tick(req.GetClock())
-	log.Printf("[SERVER] [L=%d] [LEAVE_RPC client=%d] [in=%d]", clock, id, req.GetClock())
-	s.broadcast(&pb.Event{
-		Type:     pb.EventType_EVENT_LEAVE,
-		ClientId: id,
-		Text:     fmt.Sprintf("Participant %d left Chit Chat at logical time %d", id, clock),
-		Lamport:  clock,
-	})
+	s.mu.Lock()
+	if sub := s.clients[id]; sub != nil {
+		delete(s.clients, id)
+		sub.err = errLeft
+		sub.stopGrace()
+		sub.poke()
+	}
+	delete(s.resumeTokens, id)
+	delete(s.attached, id)
+	s.mu.Unlock()
 
-	return &pb.LeaveReply{ServerClock: clock}, nil
+	clock, vc := s.leaveRooms(id, req.GetClock(), "")
+	log.Printf("[SERVER] [L=%d] [LEAVE_RPC client=%d] [in=%d] [VC=%v]", clock, id, req.GetClock(), vc)
+	return &pb.LeaveReply{ServerClock: clock, VectorClock: vc}
 }
 
 func (s *server) Subscribe(req *pb.SubscribeRequest, stream pb.Echo_SubscribeServer) error {
+	if req.GetResumeToken() != "" {
+		return s.resume(req, stream)
+	}
 	id := req.GetClientId()
-	ch := make(chan *pb.Event, 128)
 
+	// the backlog and the live events meet under s.mu: every event is
+	// either in the log copy or after the cursor, never both
+	s.mu.Lock()
+	var backlog []*pb.Event
+	if req.SinceLamport != nil {
+		backlog = s.history.since(generalRoom, req.GetSinceLamport())
+	}
+	sub := newSubscriber(id, len(s.history.events))
+	if old := s.clients[id]; old != nil {
+		old.err = status.Errorf(codes.Aborted, "participant %d subscribed again", id)
+		old.stopGrace()
+		old.poke()
+	}
+	s.clients[id] = sub
+	s.mu.Unlock()
+
+	// the join itself was counted by the Join RPC, this is its event
+	epoch, err := propose[uint64](stream.Context(), s, &pb.Command{Op: &pb.Command_Attach{Attach: &pb.AttachCommand{
+		ClientId: id,
+		Clock:    req.GetClock(),
+	}}})
 	s.mu.Lock()
-	s.clients[id] = ch
+	if err != nil {
+		if s.clients[id] == sub {
+			delete(s.clients, id)
+		}
+		s.mu.Unlock()
+		return err
+	}
+	sub.epoch = epoch
 	s.mu.Unlock()
 
-	clock := s.tick(req.GetClock())
+	// the join event is logged: the client's calls after this come after it
+	if err := stream.SendHeader(nil); err != nil {
+		log.Printf("[SERVER] [DISCONNECT client=%d] [reason=send_error] [%v]", id, err)
+		s.detach(sub, 0)
+		return err
+	}
+	if req.SinceLamport != nil {
+		log.Printf("[SERVER] [REPLAY client=%d] [since=%d] [events=%d]", id, req.GetSinceLamport(), len(backlog))
+	}
+	for _, ev := range backlog {
+		if err := stream.Send(ev); err != nil {
+			log.Printf("[SERVER] [DISCONNECT client=%d] [reason=send_error] [%v]", id, err)
+			s.detach(sub, 0)
+			return err
+		}
+	}
+	return s.serve(sub, 0, stream)
+}
 
+// applyAttach gives the participant's stream the entry's index as its
+// epoch, and logs the join event of a new one. a stream of it on another
+// replica than the one that proposed this is over.
+func (s *server) applyAttach(index, replica uint64, c *pb.AttachCommand) (uint64, error) {
+	id := c.GetClientId()
+	s.mu.Lock()
+	general := s.rooms[generalRoom]
+	if s.resumeTokens[id] == "" || !general.has(id) {
+		s.mu.Unlock()
+		return 0, status.Errorf(codes.NotFound, "participant %d left", id)
+	}
+	if sub := s.clients[id]; sub != nil && replica != s.id {
+		delete(s.clients, id)
+		sub.err = errResumed
+		sub.stopGrace()
+		sub.poke()
+	}
+	s.attached[id] = index
+	if replica == s.id && index <= s.recovered {
+		s.recover(id, index)
+	}
+	s.mu.Unlock()
+	if c.GetResumed() {
+		return index, nil
+	}
+
+	clock, vc := s.tick(general, c.GetClock(), nil, 0)
 	log.Printf("[SERVER] [L=%d] [BROADCAST_JOIN client=%d]", clock, id)
-	s.broadcast(&pb.Event{
-		Type:     pb.EventType_EVENT_JOIN,
-		ClientId: id,
-		Text:     fmt.Sprintf("Participant %d joined to Chit Chat at logical time %d", id, clock),
-		Lamport:  clock,
+	s.broadcast(general, &pb.Event{
+		Type:        pb.EventType_EVENT_JOIN,
+		ClientId:    id,
+		Text:        fmt.Sprintf("%s joined to Chit Chat at logical time %d", s.nameOf(id), clock),
+		Lamport:     clock,
+		VectorClock: vc,
 	})
+	return index, nil
+}
 
+// serve sends the events of sub to stream gen of it until the stream
+// ends. a stream that broke can be resumed for a while.
+func (s *server) serve(sub *subscriber, gen int, stream pb.Echo_SubscribeServer) error {
+	id := sub.id
+	ctx := stream.Context()
 	for {
-		select {
-		case ev, ok := <-ch:
-			if !ok {
-				log.Printf("[SERVER] [DISCONNECT client=%d] [reason=channel_closed]", id)
-				return nil
-			}
-			err := stream.Send(ev)
-			if err != nil {
+		evs, err := s.next(ctx, sub, gen)
+		switch {
+		case err == errLeft:
+			log.Printf("[SERVER] [DISCONNECT client=%d] [reason=left]", id)
+			return nil
+		case err == errResumed:
+			log.Printf("[SERVER] [DISCONNECT client=%d] [reason=resumed]", id)
+			return nil
+		case ctx.Err() != nil:
+			log.Printf("[SERVER] [DISCONNECT client=%d] [reason=context_done]", id)
+			s.detach(sub, gen)
+			return nil
+		case err != nil:
+			log.Printf("[SERVER] [DISCONNECT client=%d] [reason=lagging] [%v]", id, err)
+			s.expire(sub, gen)
+			return err
+		}
+		for _, ev := range evs {
+			if err := stream.Send(ev); err != nil {
 				log.Printf("[SERVER] [DISCONNECT client=%d] [reason=send_error] [%v]", id, err)
-				removeClient(s, id, ch)
+				s.detach(sub, gen)
 				return err
 			}
-		case <-stream.Context().Done():
-			log.Printf("[SERVER] [DISCONNECT client=%d] [reason=context_done]", id)
-			s.broadcast(&pb.Event{
-				Type:     pb.EventType_EVENT_LEAVE,
-				ClientId: id,
-				Text:     fmt.Sprintf("Participant %d left unexpectedly at logical time %d", id, clock),
-				Lamport:  clock,
-			})
-			removeClient(s, id, ch)
-			return nil
+			log.Printf("[SERVER] [L=%d] [DELIVER to client=%d] [room=%s]", ev.GetLamport(), id, ev.GetRoom())
 		}
 	}
 }
 
-func removeClient(s *server, id uint64, ch chan *pb.Event) {
-	s.mu.Lock()
-	delete(s.clients, id)
-	close(ch)
-	s.mu.Unlock()
-}
-
 func (s *server) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishReply, error) {
 	if len([]rune(req.GetText())) > 128 {
 		return nil, fmt.Errorf("message too long (>128 UTF-8 chars)")
 	}
-	clock := s.tick(req.GetClock())
-	log.Printf("[CLIENT] [L=%d] [PUBLISH_RPC from=%d] [in=%d]", req.GetClock(), req.GetClientId(), clock)
-	s.broadcast(&pb.Event{
-		Type:     pb.EventType_EVENT_USER_MSG,
-		ClientId: req.GetClientId(),
-		Text:     fmt.Sprintf("Participant %d at logical time %d: %s", req.ClientId, req.Clock, req.GetText()),
-		Lamport:  clock,
+	if _, err := roomName(req.GetRoom()); err != nil {
+		return nil, err
+	}
+	return propose[*pb.PublishReply](ctx, s, &pb.Command{Op: &pb.Command_Publish{Publish: req}})
+}
+
+func (s *server) applyPublish(req *pb.PublishRequest) (*pb.PublishReply, error) {
+	r, err := s.room(req.GetRoom())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	member := r.has(req.GetClientId())
+	s.mu.Unlock()
+	if !member {
+		return nil, status.Errorf(codes.FailedPrecondition, "participant %d is not in #%s", req.GetClientId(), r.name)
+	}
+
+	clock, vc := s.tick(r, req.GetClock(), req.GetVectorClock(), 0)
+	log.Printf("[CLIENT] [L=%d] [PUBLISH_RPC from=%d] [in=%d] [room=%s] [VC=%v]", req.GetClock(), req.GetClientId(), clock, r.name, vclock.Clock(req.GetVectorClock()))
+	// the message keeps the sender's clock: the server's merged one
+	// knows messages the sender didn't, and would order them all
+	s.broadcast(r, &pb.Event{
+		Type:        pb.EventType_EVENT_USER_MSG,
+		ClientId:    req.GetClientId(),
+		Text:        fmt.Sprintf("%s at logical time %d: %s", s.nameOf(req.GetClientId()), req.Clock, req.GetText()),
+		Lamport:     clock,
+		VectorClock: req.GetVectorClock(),
 	})
-	log.Printf("[SERVER] [L=%d] [BROADCAST_MSG from=%d]", clock, req.GetClientId())
-	return &pb.PublishReply{ServerClock: clock}, nil
+	log.Printf("[SERVER] [L=%d] [BROADCAST_MSG from=%d] [room=%s]", clock, req.GetClientId(), r.name)
+	return &pb.PublishReply{ServerClock: clock, VectorClock: vc}, nil
 }
 
 func main() {
-	addr := "127.0.0.1:50051"
+	addr := flag.String("addr", "127.0.0.1:50051", "address to serve the clients on")
+	id := flag.Uint64("id", 1, "this replica's id in -cluster")
+	clusterFlag := flag.String("cluster", "", "every replica as id=host:port of its replica listener, comma separated, this one too; none for a single server")
+	secret := flag.String("cluster-secret", os.Getenv("CHITCHAT_CLUSTER_SECRET"), "secret the replicas share, default $CHITCHAT_CLUSTER_SECRET")
+	data := flag.String("data", "", "directory for the replicated log, default chitchat-<id>")
+	maxLag := flag.Int("max-lag", 1024, "events a subscriber may leave unacked, 0 for any number")
+	lagPolicy := flag.String("lag-policy", lagDisconnect, "what to do with a subscriber beyond -max-lag: disconnect or drop")
+	resumeGrace := flag.Duration("resume-grace", 30*time.Second, "how long a participant whose stream broke may resume it before it leaves, 0 for not at all")
+	importLog := flag.String("import-log", "chitchat.log", "event log of an older version, imported on the first start")
+	importUsers := flag.String("import-users", "chitchat.users", "users file of an older version, imported on the first start")
+	flag.Parse()
+	if *lagPolicy != lagDisconnect && *lagPolicy != lagDrop {
+		log.Fatalf("[SERVER] [STARTUP_FAILED] [-lag-policy %q: want disconnect or drop]", *lagPolicy)
+	}
+
+	cluster := map[uint64]string{*id: ""}
+	if *clusterFlag != "" {
+		var err error
+		if cluster, err = parseCluster(*clusterFlag); err != nil {
+			log.Fatalf("[SERVER] [STARTUP_FAILED] [%v]", err)
+		}
+	}
+	if *data == "" {
+		*data = fmt.Sprintf("chitchat-%d", *id)
+	}
+
+	users := newAuth()
+	srv := newServer(*id, users)
+	srv.maxLag, srv.lagPolicy = *maxLag, *lagPolicy
+	srv.resumeGrace = *resumeGrace
+	users.catchUp = srv.catchUp
+
+	node, err := raft.Open(*id, cluster, *data, *secret, srv.apply)
+	if err != nil {
+		log.Fatalf("[SERVER] [STARTUP_FAILED] [%v]", err)
+	}
+	srv.node = node
+	srv.recovered = uint64(node.Len())
 
-	lis, err := net.Listen("tcp", addr)
+	lis, err := net.Listen("tcp", *addr)
 	if err != nil {
 		log.Fatalf("[SERVER] [STARTUP_FAILED] [%v]", err)
 	}
+	// the other replicas come in on a listener of their own, without
+	// the clients' interceptors
+	peerAddr := "-"
+	if len(cluster) > 1 {
+		peerAddr = cluster[*id]
+		peerLis, err := net.Listen("tcp", peerAddr)
+		if err != nil {
+			log.Fatalf("[SERVER] [STARTUP_FAILED] [%v]", err)
+		}
+		go func() {
+			if err := node.Server().Serve(peerLis); err != nil {
+				log.Fatalf("[SERVER] [SERVE_ERROR] [%v]", err)
+			}
+		}()
+	}
 
-	gs := grpc.NewServer()
-	pb.RegisterEchoServer(gs, newServer())
+	gs := grpc.NewServer(grpc.UnaryInterceptor(users.unaryAuth), grpc.StreamInterceptor(users.streamAuth))
+	pb.RegisterEchoServer(gs, srv)
 
-	log.Printf("[SERVER] [STARTUP] [addr=%s]", addr)
+	log.Printf("[SERVER] [STARTUP] [addr=%s] [replica=%d of %d peer_addr=%s] [data=%s entries=%d] [max_lag=%d policy=%s] [resume_grace=%v]", *addr, *id, len(cluster), peerAddr, *data, node.Len(), *maxLag, *lagPolicy, *resumeGrace)
 	defer log.Printf("[SERVER] [SHUTDOWN]")
 
+	node.Start()
+	if err := srv.importOld(*importLog, *importUsers); err != nil {
+		log.Fatalf("[SERVER] [IMPORT_FAILED] [%v]", err)
+	}
 	err = gs.Serve(lis)
 	if err != nil {
 		log.Fatalf("[SERVER] [SERVE_ERROR] [%v]", err)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the replicas keep the same state by applying the same commands in the
+// same order. an RPC that changes anything proposes a command, and waits
+// until this replica applied it for the reply. the streams, the
+// subscribers and their acks are not replicated, they are the replica's
+// own.
+
+// proposeTimeout is how long an RPC waits for its command, leader
+// elections included.
+const proposeTimeout = 5 * time.Second
+
+// result is what applying a command returned, for the RPC waiting for it.
+type result struct {
+	reply any
+	err   error
+}
+
+// propose puts cmd in the replicated log, and returns what applying it
+// returned here. a cmd that already has an id is proposed again: if it
+// is in the log already, it isn't applied twice.
+func propose[T any](ctx context.Context, s *server, cmd *pb.Command) (T, error) {
+	var zero T
+	if cmd.Id == "" {
+		cmd.Id = hex.EncodeToString(randomBytes(8))
+	}
+	cmd.Replica = s.id
+	ch := make(chan result, 1)
+	s.mu.Lock()
+	s.waiting[cmd.Id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.waiting, cmd.Id)
+		s.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, proposeTimeout)
+	defer cancel()
+	if err := s.node.Submit(ctx, cmd); err != nil {
+		return zero, err
+	}
+	select {
+	case r := <-ch:
+		reply, _ := r.reply.(T)
+		return reply, r.err
+	case <-ctx.Done():
+		// a leader that fell before it committed the command loses it
+		return zero, status.Errorf(codes.Unavailable, "command not committed: %v", ctx.Err())
+	}
+}
+
+// catchUp returns once this replica applied everything that was
+// committed when it was called, for a read that must not miss anything.
+func (s *server) catchUp(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, proposeTimeout)
+	defer cancel()
+	return s.node.Barrier(ctx)
+}
+
+// apply is called by the raft node with every committed entry, in log
+// order, on every replica. a forwarded command whose answer got lost is
+// sent again, and can be in the log twice: the second one only gets the
+// first one's result.
+func (s *server) apply(e *pb.Entry) {
+	cmd := e.GetCommand()
+	if cmd == nil {
+		return // a new leader's first entry
+	}
+	s.mu.Lock()
+	r, dup := s.applied[cmd.GetId()]
+	s.mu.Unlock()
+	if !dup {
+		r = s.applyOp(e)
+		s.mu.Lock()
+		s.applied[cmd.GetId()] = r
+		s.mu.Unlock()
+	}
+
+	// the proposer may have given up, or had its answer already
+	s.mu.Lock()
+	if ch := s.waiting[cmd.GetId()]; ch != nil {
+		select {
+		case ch <- r:
+			delete(s.waiting, cmd.GetId())
+		default:
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *server) applyOp(e *pb.Entry) result {
+	cmd := e.GetCommand()
+	var reply any
+	var err error
+	switch op := cmd.GetOp().(type) {
+	case *pb.Command_Register:
+		err = s.applyRegister(op.Register)
+	case *pb.Command_Login:
+		s.applyLogin(op.Login)
+	case *pb.Command_Join:
+		reply, err = s.applyJoin(op.Join)
+	case *pb.Command_Attach:
+		reply, err = s.applyAttach(e.GetIndex(), cmd.GetReplica(), op.Attach)
+	case *pb.Command_Expire:
+		s.applyExpire(op.Expire)
+	case *pb.Command_Publish:
+		reply, err = s.applyPublish(op.Publish)
+	case *pb.Command_Leave:
+		reply = s.applyLeave(op.Leave)
+	case *pb.Command_CreateRoom:
+		reply, err = s.applyCreateRoom(op.CreateRoom)
+	case *pb.Command_JoinRoom:
+		reply, err = s.applyJoinRoom(op.JoinRoom)
+	case *pb.Command_LeaveRoom:
+		reply, err = s.applyLeaveRoom(op.LeaveRoom)
+	case *pb.Command_ImportFiles:
+		err = s.applyImport(op.ImportFiles)
+	}
+	return result{reply, err}
+}
+
+// parseCluster reads -cluster: id=host:port for every replica, this one
+// too, separated by commas.
+func parseCluster(v string) (map[uint64]string, error) {
+	cluster := make(map[uint64]string)
+	for _, r := range strings.Split(v, ",") {
+		idStr, addr, ok := strings.Cut(strings.TrimSpace(r), "=")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if !ok || err != nil || id == 0 || addr == "" {
+			return nil, fmt.Errorf("-cluster: %q is not id=host:port", r)
+		}
+		if cluster[id] != "" {
+			return nil, fmt.Errorf("-cluster: replica %d twice", id)
+		}
+		cluster[id] = addr
+	}
+	return cluster, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"time"
+
+	pb "chitchat/grpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// detach is for stream gen of sub that broke. the participant stays in
+// its rooms for resumeGrace, so a client that lost the network for a
+// moment can resume it, here or on another replica, and only then
+// leaves.
+func (s *server) detach(sub *subscriber, gen int) {
+	s.mu.Lock()
+	if s.clients[sub.id] != sub || sub.gen != gen || sub.err != nil || s.resumeGrace <= 0 {
+		s.mu.Unlock()
+		s.expire(sub, gen)
+		return
+	}
+	sub.stopGrace()
+	sub.grace = time.AfterFunc(s.resumeGrace, func() { s.expire(sub, gen) })
+	s.mu.Unlock()
+	log.Printf("[SERVER] [DETACHED client=%d] [grace=%v]", sub.id, s.resumeGrace)
+}
+
+// expire makes the participant of sub leave, if stream gen is still its
+// last one here. the command does nothing if it attached on another
+// replica since.
+func (s *server) expire(sub *subscriber, gen int) {
+	s.mu.Lock()
+	current := s.clients[sub.id] == sub && sub.gen == gen
+	epoch := sub.epoch
+	s.mu.Unlock()
+	if !current {
+		return
+	}
+	_, err := propose[any](context.Background(), s, &pb.Command{Op: &pb.Command_Expire{Expire: &pb.ExpireCommand{
+		ClientId: sub.id,
+		Epoch:    epoch,
+	}}})
+	if err != nil {
+		// no leader: try again later
+		log.Printf("[SERVER] [EXPIRE_ERROR client=%d] [%v]", sub.id, err)
+		s.mu.Lock()
+		if s.clients[sub.id] == sub && sub.gen == gen {
+			sub.grace = time.AfterFunc(time.Second, func() { s.expire(sub, gen) })
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *server) applyExpire(c *pb.ExpireCommand) {
+	id := c.GetClientId()
+	s.mu.Lock()
+	gone := c.GetEpoch() != 0 && s.attached[id] == c.GetEpoch()
+	if gone {
+		if sub := s.clients[id]; sub != nil && sub.epoch == c.GetEpoch() {
+			delete(s.clients, id)
+			sub.stopGrace()
+		}
+		delete(s.resumeTokens, id)
+		delete(s.attached, id)
+	}
+	s.mu.Unlock()
+	if gone {
+		log.Printf("[SERVER] [RESUME_EXPIRED client=%d]", id)
+		s.leaveRooms(id, 0, " unexpectedly")
+	}
+}
+
+// recover stands in for a stream that was attached here before a
+// restart, its client will want to resume it. nothing is known of what
+// the stream was sent, so a resume goes on like one from another
+// replica; without one, the participant leaves after resumeGrace. must
+// hold s.mu.
+func (s *server) recover(id, epoch uint64) {
+	if old := s.clients[id]; old != nil {
+		old.stopGrace()
+	}
+	sub := newSubscriber(id, len(s.history.events))
+	sub.epoch = epoch
+	sub.recovered = true
+	sub.grace = time.AfterFunc(max(s.resumeGrace, 0), func() { s.expire(sub, 0) })
+	s.clients[id] = sub
+}
+
+// stopGrace keeps the participant from leaving when its grace is over.
+// must hold s.mu.
+func (sub *subscriber) stopGrace() {
+	if sub.grace != nil {
+		sub.grace.Stop()
+		sub.grace = nil
+	}
+}
+
+// resume is a Subscribe with a resume token. the participant didn't
+// leave, so there is no join event; the cursor goes back to after the
+// last event the client got, and what it missed is sent from the log.
+// every replica has the same log, so that works on another replica too.
+// the stream before, if this replica didn't see it break yet, ends.
+func (s *server) resume(req *pb.SubscribeRequest, stream pb.Echo_SubscribeServer) error {
+	id := req.GetClientId()
+	ctx := stream.Context()
+	name, err := roomName(req.GetLastRoom())
+	if err != nil {
+		return err
+	}
+	// after a restart this replica may not have applied the Join yet
+	if err := s.catchUp(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	token := s.resumeTokens[id]
+	s.mu.Unlock()
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(req.GetResumeToken())) != 1 {
+		log.Printf("[SERVER] [RESUME_DENIED client=%d]", id)
+		return status.Errorf(codes.NotFound, "participant %d has no stream to resume, Join again", id)
+	}
+	// the stream's new epoch: the replica it was on lets it be
+	epoch, err := propose[uint64](ctx, s, &pb.Command{Op: &pb.Command_Attach{Attach: &pb.AttachCommand{
+		ClientId: id,
+		Resumed:  true,
+	}}})
+	if err != nil {
+		log.Printf("[SERVER] [RESUME_DENIED client=%d] [%v]", id, err)
+		return err
+	}
+
+	s.mu.Lock()
+	sub := s.clients[id]
+	head := len(s.history.events)
+	if sub == nil || sub.err != nil || sub.recovered {
+		// it was on another replica, or on this one before a restart:
+		// everything may have been sent, nothing since the join acked
+		if sub != nil {
+			sub.stopGrace()
+		}
+		sub = newSubscriber(id, head)
+		if joined, ok := s.rooms[generalRoom].members[id]; ok {
+			sub.acked = joined
+		}
+		s.clients[id] = sub
+	}
+	sub.stopGrace()
+	sub.gen++
+	gen := sub.gen
+	sub.epoch = epoch
+	// the client got everything up to its last event, the stream is in
+	// log order. never before the last ack, never past what was sent.
+	from := sub.acked
+	if req.GetLastLamport() > 0 {
+		if pos, ok := s.history.pos(name, req.GetLastLamport()); ok {
+			from = max(from, min(pos+1, sub.cursor))
+		}
+	}
+	resend, missed := 0, 0
+	for pos := from; pos < head; pos++ {
+		switch {
+		case !s.wants(sub, pos):
+		case pos < sub.cursor:
+			resend++ // sent, but lost with the stream
+		default:
+			missed++ // logged while the stream was broken
+		}
+	}
+	sub.cursor = from
+	sub.poke()
+	s.mu.Unlock()
+
+	log.Printf("[SERVER] [RESUME client=%d] [after=%s L=%d] [resend=%d] [missed=%d] [epoch=%d]", id, name, req.GetLastLamport(), resend, missed, epoch)
+	// tells the client it resumed before any event comes
+	if err := stream.SendHeader(metadata.Pairs("chitchat-resumed", "true")); err != nil {
+		log.Printf("[SERVER] [DISCONNECT client=%d] [reason=send_error] [%v]", id, err)
+		s.detach(sub, gen)
+		return err
+	}
+	return s.serve(sub, gen, stream)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	pb "chitchat/grpc"
+	"chitchat/vclock"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// generalRoom is where Join puts everyone, the only room before rooms.
+const generalRoom = "general"
+
+// room is a broadcast set with its own clocks, so the lamport times and
+// vector clocks a member sees only count what happens in its rooms.
+type room struct {
+	name    string
+	members map[uint64]int // log length when each joined
+	clock   uint64
+	vclock  vclock.Clock // merged from every request and event in the room
+}
+
+func newRoom(name string) *room {
+	return &room{name: name, members: make(map[uint64]int), vclock: make(vclock.Clock)}
+}
+
+func (r *room) has(id uint64) bool {
+	_, ok := r.members[id]
+	return ok
+}
+
+// roomName checks a room name from a request. "" is the general room, a
+// leading '#' is dropped.
+func roomName(name string) (string, error) {
+	name = strings.TrimPrefix(name, "#")
+	if name == "" {
+		return generalRoom, nil
+	}
+	if len(name) > 32 {
+		return "", status.Errorf(codes.InvalidArgument, "room name longer than 32")
+	}
+	if !nameChars(name) {
+		return "", status.Errorf(codes.InvalidArgument, "room name %q: only letters, digits, '-' and '_'", name)
+	}
+	return name, nil
+}
+
+// nameChars says if name is only letters, digits, '-' and '_', like room
+// and user names must be.
+func nameChars(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// where is how event texts name a room.
+func where(name string) string {
+	if name == generalRoom {
+		return "Chit Chat"
+	}
+	return "#" + name
+}
+
+// room finds a room by a name from a request.
+func (s *server) room(name string) (*room, error) {
+	name, err := roomName(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.rooms[name]
+	if r == nil {
+		return nil, status.Errorf(codes.NotFound, "no room #%s", name)
+	}
+	return r, nil
+}
+
+func (s *server) CreateRoom(ctx context.Context, req *pb.CreateRoomRequest) (*pb.CreateRoomReply, error) {
+	if _, err := roomName(req.GetName()); err != nil {
+		return nil, err
+	}
+	return propose[*pb.CreateRoomReply](ctx, s, &pb.Command{Op: &pb.Command_CreateRoom{CreateRoom: req}})
+}
+
+func (s *server) applyCreateRoom(req *pb.CreateRoomRequest) (*pb.CreateRoomReply, error) {
+	name, _ := roomName(req.GetName())
+	s.mu.Lock()
+	if s.rooms[name] != nil {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.AlreadyExists, "room #%s exists", name)
+	}
+	r := newRoom(name)
+	s.rooms[name] = r
+	s.mu.Unlock()
+
+	clock, _ := s.tick(r, req.GetClock(), nil, 0)
+	log.Printf("[CLIENT] [L=%d] [CREATE_ROOM_RPC client=%d] [room=%s] [in=%d]", clock, req.GetClientId(), name, req.GetClock())
+	// nobody is in it yet, this only goes to the log
+	s.broadcast(r, &pb.Event{
+		Type:     pb.EventType_EVENT_ROOM_CREATED,
+		ClientId: req.GetClientId(),
+		Text:     fmt.Sprintf("%s created #%s at logical time %d", s.nameOf(req.GetClientId()), name, clock),
+		Lamport:  clock,
+	})
+	return &pb.CreateRoomReply{Room: &pb.Room{Name: name, Lamport: clock}, ServerClock: clock}, nil
+}
+
+func (s *server) ListRooms(ctx context.Context, req *pb.ListRoomsRequest) (*pb.ListRoomsReply, error) {
+	s.mu.Lock()
+	out := make([]*pb.Room, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		out = append(out, &pb.Room{Name: r.name, Members: uint32(len(r.members)), Lamport: r.clock})
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return &pb.ListRoomsReply{Rooms: out}, nil
+}
+
+func (s *server) JoinRoom(ctx context.Context, req *pb.JoinRoomRequest) (*pb.JoinRoomReply, error) {
+	if _, err := roomName(req.GetRoom()); err != nil {
+		return nil, err
+	}
+	return propose[*pb.JoinRoomReply](ctx, s, &pb.Command{Op: &pb.Command_JoinRoom{JoinRoom: req}})
+}
+
+func (s *server) applyJoinRoom(req *pb.JoinRoomRequest) (*pb.JoinRoomReply, error) {
+	id := req.GetClientId()
+	r, err := s.room(req.GetRoom())
+	if err != nil {
+		return nil, err
+	}
+
+	// like in Subscribe, an event is either in the history or goes to
+	// the member's stream
+	s.mu.Lock()
+	switch {
+	case s.attached[id] == 0:
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "participant %d is not subscribed", id)
+	case r.has(id):
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.AlreadyExists, "participant %d is in #%s", id, r.name)
+	}
+	var backlog []*pb.Event
+	if req.SinceLamport != nil {
+		backlog = s.history.since(r.name, req.GetSinceLamport())
+	}
+	r.members[id] = len(s.history.events)
+	s.mu.Unlock()
+
+	clock, vc := s.tick(r, req.GetClock(), nil, id)
+	log.Printf("[CLIENT] [L=%d] [JOIN_ROOM_RPC client=%d] [room=%s] [in=%d] [replay=%d] [VC=%v]", clock, id, r.name, req.GetClock(), len(backlog), vc)
+	s.broadcast(r, &pb.Event{
+		Type:        pb.EventType_EVENT_JOIN,
+		ClientId:    id,
+		Text:        fmt.Sprintf("%s joined to %s at logical time %d", s.nameOf(id), where(r.name), clock),
+		Lamport:     clock,
+		VectorClock: vc,
+	})
+	return &pb.JoinRoomReply{ServerClock: clock, VectorClock: vc, History: backlog}, nil
+}
+
+func (s *server) LeaveRoom(ctx context.Context, req *pb.LeaveRoomRequest) (*pb.LeaveRoomReply, error) {
+	name, err := roomName(req.GetRoom())
+	if err != nil {
+		return nil, err
+	}
+	if name == generalRoom {
+		return nil, status.Errorf(codes.InvalidArgument, "#%s is left with Leave", generalRoom)
+	}
+	return propose[*pb.LeaveRoomReply](ctx, s, &pb.Command{Op: &pb.Command_LeaveRoom{LeaveRoom: req}})
+}
+
+func (s *server) applyLeaveRoom(req *pb.LeaveRoomRequest) (*pb.LeaveRoomReply, error) {
+	id := req.GetClientId()
+	r, err := s.room(req.GetRoom())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if !r.has(id) {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "participant %d is not in #%s", id, r.name)
+	}
+	delete(r.members, id)
+	s.mu.Unlock()
+
+	clock, vc := s.tick(r, req.GetClock(), nil, id)
+	log.Printf("[CLIENT] [L=%d] [LEAVE_ROOM_RPC client=%d] [room=%s] [in=%d] [VC=%v]", clock, id, r.name, req.GetClock(), vc)
+	s.broadcast(r, &pb.Event{
+		Type:        pb.EventType_EVENT_LEAVE,
+		ClientId:    id,
+		Text:        fmt.Sprintf("%s left %s at logical time %d", s.nameOf(id), where(r.name), clock),
+		Lamport:     clock,
+		VectorClock: vc,
+	})
+	return &pb.LeaveRoomReply{ServerClock: clock, VectorClock: vc}, nil
+}
+
+// leaveRooms takes id out of every room it is in and tells the rest, by
+// name so the log is the same every time. clock is the lamport time the
+// participant sent, reason goes in the texts. it returns the clocks of
+// the leave in the general room, zero if id wasn't in it.
+func (s *server) leaveRooms(id, clock uint64, reason string) (uint64, vclock.Clock) {
+	s.mu.Lock()
+	var rooms []*room
+	for _, r := range s.rooms {
+		if r.has(id) {
+			delete(r.members, id)
+			rooms = append(rooms, r)
+		}
+	}
+	general := s.rooms[generalRoom]
+	s.mu.Unlock()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+
+	var genClock uint64
+	var genVC vclock.Clock
+	for _, r := range rooms {
+		c, vc := s.tick(r, clock, nil, id)
+		s.broadcast(r, &pb.Event{
+			Type:        pb.EventType_EVENT_LEAVE,
+			ClientId:    id,
+			Text:        fmt.Sprintf("%s left %s%s at logical time %d", s.nameOf(id), where(r.name), reason, c),
+			Lamport:     c,
+			VectorClock: vc,
+		})
+		if r == general {
+			genClock, genVC = c, vc
+		}
+	}
+	return genClock, genVC
+}
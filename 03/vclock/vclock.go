@@ -0,0 +1,98 @@
+// Package vclock is a vector clock keyed by participant id. unlike a
+// lamport time it can tell two concurrent events apart from ones where
+// one happened before the other.
+package vclock
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Clock counts the events of every participant that are known. a
+// missing id counts as 0.
+type Clock map[uint64]uint64
+
+// Order is how two clocks relate.
+type Order int
+
+const (
+	Equal      Order = iota
+	Before           // a happened before b
+	After            // b happened before a
+	Concurrent       // neither knew about the other
+)
+
+func (o Order) String() string {
+	return [...]string{"equal", "before", "after", "concurrent"}[o]
+}
+
+// Copy returns a clock that doesn't share the map, nil stays nil.
+func (c Clock) Copy() Clock {
+	if c == nil {
+		return nil
+	}
+	out := make(Clock, len(c))
+	for id, n := range c {
+		out[id] = n
+	}
+	return out
+}
+
+// Merge takes the max of every entry of o into c.
+func (c Clock) Merge(o Clock) {
+	for id, n := range o {
+		if n > c[id] {
+			c[id] = n
+		}
+	}
+}
+
+// Compare says how a relates to b.
+func Compare(a, b Clock) Order {
+	less, more := false, false
+	for id := range union(a, b) {
+		switch {
+		case a[id] < b[id]:
+			less = true
+		case a[id] > b[id]:
+			more = true
+		}
+	}
+	switch {
+	case less && more:
+		return Concurrent
+	case less:
+		return Before
+	case more:
+		return After
+	}
+	return Equal
+}
+
+func union(a, b Clock) map[uint64]bool {
+	ids := make(map[uint64]bool, len(a)+len(b))
+	for id := range a {
+		ids[id] = true
+	}
+	for id := range b {
+		ids[id] = true
+	}
+	return ids
+}
+
+// String prints the entries sorted by id, like "1:3 2:1".
+func (c Clock) String() string {
+	ids := make([]uint64, 0, len(c))
+	for id, n := range c {
+		if n > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprintf("%d:%d", id, c[id])
+	}
+	return strings.Join(parts, " ")
+}